@@ -0,0 +1,110 @@
+package deduplicate
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded is returned when this pod already has as many getters running and queued as it allows; it is never cached as a failure
+var ErrOverloaded = errors.New("too many getters in flight on this pod")
+
+// caps how many getters run at once in this process, with a bounded queue of callers waiting for a turn
+type inFlightLimit struct {
+	maxInFlight int
+	maxQueued   int
+	aging       time.Duration
+
+	inFlight int
+	queue    []*inFlightWaiter
+	lock     *sync.Mutex
+}
+
+type inFlightWaiter struct {
+	priority Priority
+	queuedAt time.Time
+	ready    chan struct{}
+}
+
+func newInFlightLimit(maxInFlight int, maxQueued int, aging time.Duration) *inFlightLimit {
+	return &inFlightLimit{
+		maxInFlight: maxInFlight,
+		maxQueued:   maxQueued,
+		aging:       aging,
+		lock:        &sync.Mutex{},
+	}
+}
+
+// waits for a turn to run the getter, and returns a function that hands it to the next waiter
+func (ifl *inFlightLimit) acquire(ctx context.Context, priority Priority) (func(), error) {
+	if ifl == nil {
+		return func() {}, nil
+	}
+	ifl.lock.Lock()
+	if ifl.inFlight < ifl.maxInFlight && len(ifl.queue) == 0 {
+		ifl.inFlight++
+		ifl.lock.Unlock()
+		return ifl.release, nil
+	}
+	if len(ifl.queue) >= ifl.maxQueued {
+		ifl.lock.Unlock()
+		return nil, ErrOverloaded
+	}
+	waiter := &inFlightWaiter{
+		priority: priority,
+		queuedAt: time.Now(),
+		ready:    make(chan struct{}),
+	}
+	ifl.queue = append(ifl.queue, waiter)
+	ifl.lock.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return ifl.release, nil
+	case <-ctx.Done():
+		ifl.lock.Lock()
+		for i, queued := range ifl.queue {
+			if queued == waiter {
+				ifl.queue = append(ifl.queue[:i], ifl.queue[i+1:]...)
+				ifl.lock.Unlock()
+				return nil, ctx.Err()
+			}
+		}
+		ifl.lock.Unlock()
+		// the turn was handed over just as the context ended, so pass it on
+		ifl.release()
+		return nil, ctx.Err()
+	}
+}
+
+// hands the turn to the most urgent waiter (waiting raises priority the same way it does for stored tasks), or frees it
+func (ifl *inFlightLimit) release() {
+	ifl.lock.Lock()
+	defer ifl.lock.Unlock()
+	if len(ifl.queue) == 0 {
+		ifl.inFlight--
+		return
+	}
+	now := time.Now()
+	next := 0
+	for i, waiter := range ifl.queue {
+		if ifl.urgency(waiter, now) > ifl.urgency(ifl.queue[next], now) {
+			next = i
+		}
+	}
+	waiter := ifl.queue[next]
+	ifl.queue = append(ifl.queue[:next], ifl.queue[next+1:]...)
+	close(waiter.ready)
+}
+
+func (ifl *inFlightLimit) urgency(waiter *inFlightWaiter, now time.Time) float64 {
+	return float64(waiter.priority) + now.Sub(waiter.queuedAt).Seconds()/ifl.aging.Seconds()
+}
+
+// getters running and callers waiting to run one in this process
+func (ifl *inFlightLimit) counts() (int, int) {
+	ifl.lock.Lock()
+	defer ifl.lock.Unlock()
+	return ifl.inFlight, len(ifl.queue)
+}
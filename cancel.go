@@ -0,0 +1,66 @@
+package deduplicate
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrCancelled is returned to the caller running a task and to everyone waiting on it once the task is cancelled with Cancel
+var ErrCancelled = errors.New("task was cancelled")
+
+// how often the pod running a getter checks whether its task has been cancelled
+const cancellationPollInterval = time.Second
+
+// Cancel stops a task that is in flight or queued on any pod; the next Load of the key starts it afresh
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) Cancel(key KEY_TYPE) error {
+	err := tp.enter()
+	if err != nil {
+		return err
+	}
+	defer tp.leave()
+
+	keyStr, err := tp.getKeyStr(key)
+	if err != nil {
+		return err
+	}
+	return tp.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("key = ?", keyStr).Delete(&QueuedTask{})
+		if result.Error != nil {
+			return result.Error
+		}
+		// the row is left in place (rather than deleted) so that waiting pods can tell a cancellation from a claim that was given up
+		return tp.store.cancel(tx, keyStr)
+	})
+}
+
+// cancels the getter's context once its task is cancelled, until stop is called
+// stop waits for the watcher to finish, so that no lookup outlives the caller's hold on the pool (and with it the store's batchers)
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) watchCancellation(keyStr string, claimID string, cancel context.CancelCauseFunc) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(cancellationPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			// lookup errors are ignored; the next tick tries again
+			pendingTask, err := tp.getPendingTask(keyStr)
+			if err == nil && pendingTask.Cancelled && pendingTask.ClaimID == claimID {
+				cancel(ErrCancelled)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
@@ -0,0 +1,265 @@
+package deduplicate
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrCircuitOpen is returned without calling the getter while the circuit breaker is open; it is never cached as a failure
+var ErrCircuitOpen = errors.New("getter circuit breaker is open")
+
+type CircuitState int
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// stops calling a failing getter for a while, across every pod sharing the database
+type CircuitBreaker struct {
+	// the share of getter calls in a window that must fail for the circuit to open (0.5 by default)
+	FailureRatio float64
+	// the fewest calls in a window that can open the circuit (10 by default)
+	MinRequests int
+	// how long calls are counted for before the counts start over (1 minute by default)
+	Window time.Duration
+	// how long the circuit stays open before probing the getter again (30 seconds by default)
+	OpenFor time.Duration
+	// how many probe calls run while half-open; all of them must succeed to close the circuit (1 by default)
+	HalfOpenProbes int
+}
+
+func (cb CircuitBreaker) withDefaults() CircuitBreaker {
+	if cb.FailureRatio <= 0 {
+		cb.FailureRatio = 0.5
+	}
+	if cb.MinRequests <= 0 {
+		cb.MinRequests = 10
+	}
+	if cb.Window <= 0 {
+		cb.Window = time.Minute
+	}
+	if cb.OpenFor <= 0 {
+		cb.OpenFor = time.Second * 30
+	}
+	if cb.HalfOpenProbes <= 0 {
+		cb.HalfOpenProbes = 1
+	}
+	return cb
+}
+
+// the circuit breaker's state, shared by every pod
+type CircuitBreakerState struct {
+	Namespace string `gorm:"primaryKey"`
+	State     CircuitState
+	// when State last changed
+	ChangedAt time.Time
+
+	// calls counted in the current window, while closed
+	WindowStart time.Time
+	Requests    int
+	Failures    int
+
+	// probe calls started and succeeded, while half-open
+	Probes    int
+	Successes int
+}
+
+// the circuit breaker's state and counts, as seen by Stats
+type CircuitBreakerStats struct {
+	State    CircuitState
+	Requests int
+	Failures int
+}
+
+// errors from the getter that count against it, timeouts included; a call that never got capacity, or was cancelled with Cancel, says nothing about the upstream's health
+func countsAgainstCircuit(err error) bool {
+	return err != nil && !isUnrecordedError(err) && !errors.Is(err, ErrCancelled)
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) getCircuitState() (CircuitBreakerState, error) {
+	states := []CircuitBreakerState{}
+	result := tp.db.Where("namespace = ?", tp.getterName).Find(&states)
+	if result.Error != nil {
+		return CircuitBreakerState{}, result.Error
+	}
+	if len(states) == 0 {
+		return CircuitBreakerState{Namespace: tp.getterName, State: CircuitClosed}, nil
+	}
+	return states[0], nil
+}
+
+// locks the state row for the rest of the transaction, creating it if needed
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) lockCircuitState(tx *gorm.DB, now time.Time) (CircuitBreakerState, error) {
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&CircuitBreakerState{
+		Namespace:   tp.getterName,
+		State:       CircuitClosed,
+		ChangedAt:   now,
+		WindowStart: now,
+	})
+	if result.Error != nil {
+		return CircuitBreakerState{}, result.Error
+	}
+	state := CircuitBreakerState{}
+	result = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("namespace = ?", tp.getterName).Take(&state)
+	return state, result.Error
+}
+
+// fails with ErrCircuitOpen unless the getter may be called; probe reports whether this call is one of the half-open probes
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) enterCircuit() (probe bool, err error) {
+	if tp.circuitBreaker == nil {
+		return false, nil
+	}
+	// the common case needs no lock
+	state, err := tp.getCircuitState()
+	if err != nil {
+		return false, err
+	}
+	if state.State == CircuitClosed {
+		return false, nil
+	}
+
+	cb := tp.circuitBreaker
+	err = tp.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		state, err := tp.lockCircuitState(tx, now)
+		if err != nil {
+			return err
+		}
+		switch state.State {
+		case CircuitClosed:
+			return nil
+		case CircuitOpen:
+			if now.Before(state.ChangedAt.Add(cb.OpenFor)) {
+				return ErrCircuitOpen
+			}
+			state.State = CircuitHalfOpen
+			state.ChangedAt = now
+			state.Probes = 0
+			state.Successes = 0
+		case CircuitHalfOpen:
+			// probes whose pods crashed would otherwise hold the circuit half-open forever
+			if !now.Before(state.ChangedAt.Add(cb.OpenFor)) {
+				state.ChangedAt = now
+				state.Probes = 0
+				state.Successes = 0
+			}
+		}
+		if state.Probes >= cb.HalfOpenProbes {
+			return ErrCircuitOpen
+		}
+		state.Probes++
+		probe = true
+		return tx.Save(&state).Error
+	})
+	return probe, err
+}
+
+// hands a half-open probe back when its call never reached the getter or ended without saying anything about it, so another call can take its place
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) abandonProbe(probe bool) {
+	if !probe {
+		return
+	}
+	err := tp.db.Transaction(func(tx *gorm.DB) error {
+		state, err := tp.lockCircuitState(tx, time.Now())
+		if err != nil {
+			return err
+		}
+		if state.State != CircuitHalfOpen || state.Probes <= 0 {
+			return nil
+		}
+		state.Probes--
+		return tx.Save(&state).Error
+	})
+	if err != nil {
+		log.Printf("error abandoning circuit breaker probe: %v", err)
+	}
+}
+
+// counts a finished getter call, opening or closing the circuit as needed
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) recordCircuit(failed bool, probe bool) {
+	if tp.circuitBreaker == nil {
+		return
+	}
+	cb := tp.circuitBreaker
+	err := tp.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		state, err := tp.lockCircuitState(tx, now)
+		if err != nil {
+			return err
+		}
+		switch state.State {
+		case CircuitClosed:
+			if !now.Before(state.WindowStart.Add(cb.Window)) {
+				state.WindowStart = now
+				state.Requests = 0
+				state.Failures = 0
+			}
+			state.Requests++
+			if failed {
+				state.Failures++
+			}
+			if state.Requests >= cb.MinRequests && float64(state.Failures)/float64(state.Requests) >= cb.FailureRatio {
+				state.State = CircuitOpen
+				state.ChangedAt = now
+			}
+		case CircuitHalfOpen:
+			// calls that started before the circuit opened don't decide whether it closes
+			if !probe {
+				return nil
+			}
+			if failed {
+				state.State = CircuitOpen
+				state.ChangedAt = now
+			} else {
+				state.Successes++
+				if state.Successes >= cb.HalfOpenProbes {
+					state.State = CircuitClosed
+					state.ChangedAt = now
+					state.WindowStart = now
+					state.Requests = 0
+					state.Failures = 0
+				}
+			}
+		case CircuitOpen:
+			return nil
+		}
+		return tx.Save(&state).Error
+	})
+	if err != nil {
+		log.Printf("error recording circuit breaker outcome: %v", err)
+	}
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) circuitBreakerStats() (*CircuitBreakerStats, error) {
+	if tp.circuitBreaker == nil {
+		return nil, nil
+	}
+	state, err := tp.getCircuitState()
+	if err != nil {
+		return nil, err
+	}
+	return &CircuitBreakerStats{
+		State:    state.State,
+		Requests: state.Requests,
+		Failures: state.Failures,
+	}, nil
+}
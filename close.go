@@ -0,0 +1,103 @@
+package deduplicate
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+// ErrClosed is returned by calls made after Close
+var ErrClosed = errors.New("task pool is closed")
+
+// tracks a call so that Close can wait for it; every successful enter must be matched by a leave
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) enter() error {
+	tp.closeLock.RLock()
+	defer tp.closeLock.RUnlock()
+	if tp.closed {
+		return ErrClosed
+	}
+	tp.inFlight.Add(1)
+	return nil
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) leave() {
+	tp.inFlight.Done()
+}
+
+// runs work in the background that Close waits for; only call it from work that is itself tracked
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) goTracked(work func()) {
+	tp.inFlight.Add(1)
+	go func() {
+		defer tp.inFlight.Done()
+		work()
+	}()
+}
+
+// derives a context that also ends, with ErrClosed as its cause, once Close starts; call stop once it's no longer needed
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) untilClosing(ctx context.Context) (context.Context, func()) {
+	closingCtx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		select {
+		case <-tp.closing:
+			cancel(ErrClosed)
+		case <-closingCtx.Done():
+		}
+	}()
+	return closingCtx, func() { cancel(nil) }
+}
+
+// Close stops new calls (which fail with ErrClosed), interrupts waits on other pods and for capacity, and waits for running getters and their writes to finish
+// once ctx is done it stops waiting and returns ctx's error; either way, this pod's unfinished pending claims are released so other pods can take them over
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) Close(ctx context.Context) error {
+	tp.closeLock.Lock()
+	if tp.closed {
+		tp.closeLock.Unlock()
+		return ErrClosed
+	}
+	tp.closed = true
+	close(tp.closing)
+	tp.closeLock.Unlock()
+
+	for _, canceller := range tp.cancellers {
+		canceller()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		tp.inFlight.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if tp.sliding != nil {
+		tp.flushTouches()
+	}
+	tp.releaseClaims()
+	tp.completedCache.StopReaping()
+	tp.failureCache.StopReaping()
+
+	// work that is still running may yet need the batchers and the write-behind queue
+	go func() {
+		<-drained
+		close(tp.writes.queue)
+		tp.store.close()
+	}()
+	return err
+}
+
+// gives up the pending claims and getter slots this pod still holds, rather than leaving them until they expire
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) releaseClaims() {
+	err := tp.store.releaseOwned(tp.podID)
+	if err != nil {
+		log.Printf("error releasing pending tasks: %v", err)
+	}
+	result := tp.db.Where("namespace = ? AND owner LIKE ?", tp.getterName, tp.podID+"-%").Delete(&GetterSlot{})
+	if result.Error != nil {
+		log.Printf("error releasing getter slots: %v", result.Error)
+	}
+}
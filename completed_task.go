@@ -2,40 +2,108 @@ package deduplicate
 
 import (
 	"encoding/json"
-	"log"
 	"time"
 
-	"github.com/nuvi/unicycle/defaults"
+	"github.com/nuvi/go-dataloader"
+	"gorm.io/gorm"
 )
 
 type CompletedTask struct {
 	Key       string    `gorm:"primaryKey"`
 	CreatedAt time.Time `gorm:"default:NOW()"`
+	ExpiresAt time.Time `gorm:"index"`
 	Value     string
+
+	ComputedBy     string
+	GetterDuration time.Duration
 }
 
-func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) getCompletedTask(keyStr string) (VALUE_TYPE, error) {
-	completedTask, err := tp.completedTaskBatcher.Load(keyStr)
-	if err != nil {
-		return defaults.ZeroValue[VALUE_TYPE](), err
+// rows written before expires_at existed fall back to the pool-wide TTL
+func (ct CompletedTask) expiresAt(ttl time.Duration) time.Time {
+	if ct.ExpiresAt.IsZero() {
+		return ct.CreatedAt.Add(ttl)
+	}
+	return ct.ExpiresAt
+}
+
+// a decoded completed value along with the time it stops being fresh and how it was computed
+type storedValue[VALUE_TYPE any] struct {
+	value     VALUE_TYPE
+	createdAt time.Time
+	expiresAt time.Time
+
+	computedBy     string
+	getterDuration time.Duration
+}
+
+func (sv storedValue[VALUE_TYPE]) isFresh() bool {
+	return time.Now().Before(sv.expiresAt)
+}
+
+func (sv storedValue[VALUE_TYPE]) result(source Source) Result[VALUE_TYPE] {
+	return Result[VALUE_TYPE]{
+		Value:          sv.value,
+		Source:         source,
+		Stale:          !sv.isFresh(),
+		CreatedAt:      sv.createdAt,
+		ExpiresAt:      sv.expiresAt,
+		ComputedBy:     sv.computedBy,
+		GetterDuration: sv.getterDuration,
+	}
+}
+
+// rows are kept past their expiry only while they can still be served stale
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) retainedUntil(expiresAt time.Time) time.Time {
+	return expiresAt.Add(tp.staleRetention())
+}
+
+// returns the stored value along with the time it expires; rows past their retention are treated as missing even if they haven't been reaped yet
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) decodeCompletedTask(completedTask CompletedTask) (storedValue[VALUE_TYPE], error) {
+	expiresAt := completedTask.expiresAt(tp.valueTTL)
+	if !time.Now().Before(tp.retainedUntil(expiresAt)) {
+		return storedValue[VALUE_TYPE]{}, dataloader.ErrMissingResponse
 	}
 	var value VALUE_TYPE
-	err = json.Unmarshal([]byte(completedTask.Value), &value)
-	return value, err
+	err := json.Unmarshal([]byte(completedTask.Value), &value)
+	if err != nil {
+		return storedValue[VALUE_TYPE]{}, err
+	}
+	return storedValue[VALUE_TYPE]{
+		value:          value,
+		createdAt:      completedTask.CreatedAt,
+		expiresAt:      expiresAt,
+		computedBy:     completedTask.ComputedBy,
+		getterDuration: completedTask.GetterDuration,
+	}, nil
 }
 
-func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) createCompletedTask(keyStr string, value VALUE_TYPE) {
-	bytes, err := json.Marshal(value)
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) cacheCompleted(key KEY_TYPE, stored storedValue[VALUE_TYPE]) {
+	tp.completedCache.Set(key, stored, tp.retainedUntil(stored.expiresAt))
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) createCompletedTask(key KEY_TYPE, keyStr string, claimID string, stored storedValue[VALUE_TYPE]) error {
+	bytes, err := json.Marshal(stored.value)
 	if err != nil {
-		log.Println(err)
-	} else {
-		result := tp.db.Create(&CompletedTask{
+		return err
+	}
+	var tags []string
+	if tp.tagsFunc != nil {
+		tags = tp.tagsFunc(key, stored.value)
+	}
+	// the result, its tags and the end of this pod's claim are written together, so other pods never see a finished task that still looks pending
+	return tp.db.Transaction(func(tx *gorm.DB) error {
+		err := tp.store.complete(tx, CompletedTask{
 			Key:       keyStr,
-			CreatedAt: time.Now(),
+			CreatedAt: stored.createdAt,
+			ExpiresAt: stored.expiresAt,
 			Value:     string(bytes),
-		})
-		if result.Error != nil {
-			log.Println(result.Error)
+
+			ComputedBy:     stored.computedBy,
+			GetterDuration: stored.getterDuration,
+		}, claimID)
+		if err != nil {
+			return err
 		}
-	}
+		return tp.storeTags(tx, keyStr, tags)
+	})
 }
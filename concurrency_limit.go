@@ -0,0 +1,182 @@
+package deduplicate
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+// how often a caller waiting for a getter slot checks whether it may take one
+const slotPollInterval = time.Millisecond * 250
+
+// ErrConcurrencyLimited is returned when no getter slot became free within the configured wait; it is never cached as a failure
+var ErrConcurrencyLimited = errors.New("cluster-wide getter concurrency limit reached")
+
+// one of the limited number of getter executions allowed at once across all pods; leases are renewed while the getter runs, so a crashed pod's slot frees up once its lease expires
+type GetterSlot struct {
+	Namespace string `gorm:"primaryKey"`
+	Slot      int    `gorm:"primaryKey;autoIncrement:false"`
+	Owner     string
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+// a caller waiting for a getter slot; waiters are served in order of effective priority
+type GetterSlotWaiter struct {
+	ID          uint64 `gorm:"primaryKey"`
+	Namespace   string `gorm:"index"`
+	Priority    Priority
+	CreatedAt   time.Time `gorm:"default:NOW()"`
+	HeartbeatAt time.Time `gorm:"index"`
+}
+
+type concurrencyLimit struct {
+	limit   int
+	maxWait time.Duration
+	lease   time.Duration
+	tokens  *atomic.Uint64
+}
+
+// waits for one of the cluster-wide getter slots, and returns a function that gives it back
+// while waiting, the waiter takes on any higher priority that callers waiting on keyStr's claim have raised it to
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) acquireGetterSlot(ctx context.Context, keyStr string, priority Priority) (func(), error) {
+	if tp.concurrencyLimit == nil {
+		return func() {}, nil
+	}
+	cl := tp.concurrencyLimit
+	owner := tp.podID + "-" + strconv.FormatUint(cl.tokens.Add(1), 10)
+
+	now := time.Now()
+	waiter := GetterSlotWaiter{
+		Namespace:   tp.getterName,
+		Priority:    priority,
+		CreatedAt:   now,
+		HeartbeatAt: now,
+	}
+	result := tp.db.Create(&waiter)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	defer func() {
+		result := tp.db.Delete(&GetterSlotWaiter{}, waiter.ID)
+		if result.Error != nil {
+			log.Printf("error removing getter slot waiter: %v", result.Error)
+		}
+	}()
+
+	deadline := now.Add(cl.maxWait)
+	for {
+		slot, acquired, err := tp.tryAcquireGetterSlot(waiter.ID, owner)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			return tp.holdGetterSlot(slot, owner), nil
+		}
+		if cl.maxWait >= 0 && !time.Now().Before(deadline) {
+			return nil, ErrConcurrencyLimited
+		}
+
+		select {
+		case <-time.After(slotPollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		pendingTask, err := tp.getPendingTask(keyStr)
+		if err == nil && pendingTask.Priority > waiter.Priority {
+			waiter.Priority = pendingTask.Priority
+		}
+		result := tp.db.Model(&GetterSlotWaiter{}).Where("id = ?", waiter.ID).Updates(map[string]any{
+			"heartbeat_at": time.Now(),
+			"priority":     waiter.Priority,
+		})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+	}
+}
+
+// takes a free slot, but only if no live waiter with a higher effective priority would be left without one
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) tryAcquireGetterSlot(waiterID uint64, owner string) (int, bool, error) {
+	cl := tp.concurrencyLimit
+	now := time.Now()
+
+	var held int64
+	result := tp.db.Model(&GetterSlot{}).Where("namespace = ? AND expires_at > ?", tp.getterName, now).Count(&held)
+	if result.Error != nil {
+		return 0, false, result.Error
+	}
+	free := int64(cl.limit) - held
+	if free <= 0 {
+		return 0, false, nil
+	}
+
+	var ahead int64
+	result = tp.db.Table("getter_slot_waiters AS other").
+		Joins("JOIN getter_slot_waiters AS me ON me.id = ? AND me.namespace = other.namespace", waiterID).
+		Where("other.id <> me.id AND other.heartbeat_at > ?", now.Add(-slotPollInterval*4)).
+		Where("(" + tp.effectivePrioritySQL("other") + " > " + tp.effectivePrioritySQL("me") + ") OR (" + tp.effectivePrioritySQL("other") + " = " + tp.effectivePrioritySQL("me") + " AND other.id < me.id)").
+		Count(&ahead)
+	if result.Error != nil {
+		return 0, false, result.Error
+	}
+	if ahead >= free {
+		return 0, false, nil
+	}
+
+	for slot := 0; slot < cl.limit; slot++ {
+		result := tp.db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "namespace"}, {Name: "slot"}},
+			DoUpdates: clause.AssignmentColumns([]string{"owner", "expires_at"}),
+			Where: clause.Where{Exprs: []clause.Expression{
+				clause.Lt{Column: clause.Column{Table: "getter_slots", Name: "expires_at"}, Value: now},
+			}},
+		}).Create(&GetterSlot{
+			Namespace: tp.getterName,
+			Slot:      slot,
+			Owner:     owner,
+			ExpiresAt: now.Add(cl.lease),
+		})
+		if result.Error != nil {
+			return 0, false, result.Error
+		}
+		if result.RowsAffected > 0 {
+			return slot, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// renews the slot's lease until the returned function is called, which releases it
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) holdGetterSlot(slot int, owner string) func() {
+	cl := tp.concurrencyLimit
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(cl.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				result := tp.db.Model(&GetterSlot{}).
+					Where("namespace = ? AND slot = ? AND owner = ?", tp.getterName, slot, owner).
+					Update("expires_at", time.Now().Add(cl.lease))
+				if result.Error != nil {
+					log.Printf("error renewing getter slot lease: %v", result.Error)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		result := tp.db.Where("namespace = ? AND slot = ? AND owner = ?", tp.getterName, slot, owner).Delete(&GetterSlot{})
+		if result.Error != nil {
+			log.Printf("error releasing getter slot: %v", result.Error)
+		}
+	}
+}
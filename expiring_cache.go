@@ -0,0 +1,107 @@
+package deduplicate
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nuvi/unicycle/multithread"
+)
+
+type expiringCacheValue[VALUE_TYPE any] struct {
+	expiresAt time.Time
+	value     VALUE_TYPE
+}
+
+func (cached expiringCacheValue[VALUE_TYPE]) isExpired() bool {
+	return !time.Now().Before(cached.expiresAt)
+}
+
+// like a TTL cache, except each entry carries its own expiration time, so in-memory values can never outlive the rows they were loaded from
+type expiringCache[KEY_TYPE comparable, VALUE_TYPE any] struct {
+	cache     map[KEY_TYPE]expiringCacheValue[VALUE_TYPE]
+	lock      *sync.RWMutex
+	canceller func()
+}
+
+func newExpiringCache[KEY_TYPE comparable, VALUE_TYPE any](reapFrequency time.Duration) *expiringCache[KEY_TYPE, VALUE_TYPE] {
+	cache := &expiringCache[KEY_TYPE, VALUE_TYPE]{
+		cache: map[KEY_TYPE]expiringCacheValue[VALUE_TYPE]{},
+		lock:  &sync.RWMutex{},
+	}
+	cache.canceller = multithread.Repeat(cache.Reap, reapFrequency, false)
+	return cache
+}
+
+func (ec *expiringCache[KEY_TYPE, VALUE_TYPE]) Set(key KEY_TYPE, value VALUE_TYPE, expiresAt time.Time) {
+	if !time.Now().Before(expiresAt) {
+		return
+	}
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	ec.cache[key] = expiringCacheValue[VALUE_TYPE]{
+		value:     value,
+		expiresAt: expiresAt,
+	}
+}
+
+func (ec *expiringCache[KEY_TYPE, VALUE_TYPE]) Get(key KEY_TYPE) (VALUE_TYPE, bool) {
+	value, _, ok := ec.GetWithExpiry(key)
+	return value, ok
+}
+
+func (ec *expiringCache[KEY_TYPE, VALUE_TYPE]) GetWithExpiry(key KEY_TYPE) (VALUE_TYPE, time.Time, bool) {
+	ec.lock.RLock()
+	cached, ok := ec.cache[key]
+	ec.lock.RUnlock()
+	if ok && cached.isExpired() {
+		ok = false
+		go ec.removeExpired(key, cached.expiresAt)
+	}
+	return cached.value, cached.expiresAt, ok
+}
+
+func (ec *expiringCache[KEY_TYPE, VALUE_TYPE]) Remove(key KEY_TYPE) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	delete(ec.cache, key)
+}
+
+// removes the entry only if it is still the expired one that was read, so a value Set in the meantime survives
+func (ec *expiringCache[KEY_TYPE, VALUE_TYPE]) removeExpired(key KEY_TYPE, expiresAt time.Time) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	cached, ok := ec.cache[key]
+	if ok && cached.expiresAt.Equal(expiresAt) && cached.isExpired() {
+		delete(ec.cache, key)
+	}
+}
+
+func (ec *expiringCache[KEY_TYPE, VALUE_TYPE]) RemoveWhere(predicate func(KEY_TYPE) bool) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	for key := range ec.cache {
+		if predicate(key) {
+			delete(ec.cache, key)
+		}
+	}
+}
+
+func (ec *expiringCache[KEY_TYPE, VALUE_TYPE]) Clear() {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	ec.cache = map[KEY_TYPE]expiringCacheValue[VALUE_TYPE]{}
+}
+
+func (ec *expiringCache[KEY_TYPE, VALUE_TYPE]) StopReaping() {
+	ec.canceller()
+}
+
+func (ec *expiringCache[KEY_TYPE, VALUE_TYPE]) Reap() {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	for key, cached := range ec.cache {
+		if cached.isExpired() {
+			delete(ec.cache, key)
+		}
+	}
+}
@@ -2,40 +2,53 @@ package deduplicate
 
 import (
 	"errors"
-	"log"
 	"time"
 
-	"github.com/nuvi/go-dataloader"
+	"gorm.io/gorm"
 )
 
 type FailedTask struct {
 	Key         string    `gorm:"primaryKey"`
 	CreatedAt   time.Time `gorm:"default:NOW()"`
+	ExpiresAt   time.Time `gorm:"index"`
 	ErrorString string
+	// set when the getter ran past its timeout, so that every pod can recognise ErrGetterTimeout
+	TimedOut bool
+}
+
+func newFailedTask(keyStr string, err error, createdAt time.Time, expiresAt time.Time) FailedTask {
+	return FailedTask{
+		Key:         keyStr,
+		CreatedAt:   createdAt,
+		ExpiresAt:   expiresAt,
+		ErrorString: err.Error(),
+		TimedOut:    errors.Is(err, ErrGetterTimeout),
+	}
 }
 
 func (ft FailedTask) Error() string {
 	return "cached failure: " + ft.ErrorString
 }
 
-func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) getFailedTask(keyStr string) error {
-	failedTask, err := tp.failedTaskBatcher.Load(keyStr)
-	if err != nil {
-		if errors.Is(err, dataloader.ErrMissingResponse) {
-			return nil
-		}
-		return err
+func (ft FailedTask) Unwrap() error {
+	if ft.TimedOut {
+		return ErrGetterTimeout
 	}
-	return failedTask
+	return nil
 }
 
-func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) createFailedTask(keyStr string, prior error) {
-	result := tp.db.Create(&FailedTask{
-		Key:         keyStr,
-		CreatedAt:   time.Now(),
-		ErrorString: prior.Error(),
-	})
-	if result.Error != nil {
-		log.Println(result.Error)
+// rows written before expires_at existed fall back to the pool-wide TTL
+func (ft FailedTask) expiresAt(ttl time.Duration) time.Time {
+	if ft.ExpiresAt.IsZero() {
+		return ft.CreatedAt.Add(ttl)
 	}
+	return ft.ExpiresAt
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) createFailedTask(keyStr string, claimID string, prior error, createdAt time.Time, expiresAt time.Time) error {
+	failedTask := newFailedTask(keyStr, prior, createdAt, expiresAt)
+	// like createCompletedTask, the failure and the end of this pod's claim are written together
+	return tp.db.Transaction(func(tx *gorm.DB) error {
+		return tp.store.fail(tx, failedTask, claimID)
+	})
 }
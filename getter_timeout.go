@@ -0,0 +1,29 @@
+package deduplicate
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrGetterTimeout is matched (with errors.Is) by timeouts from this pod and by timeouts recorded by any other pod
+var ErrGetterTimeout = errors.New("getter timed out")
+
+type GetterTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (gte GetterTimeoutError) Error() string {
+	return "getter timed out after " + gte.Timeout.String()
+}
+
+func (gte GetterTimeoutError) Unwrap() error {
+	return ErrGetterTimeout
+}
+
+// the per-call timeout wins over the pool's; zero means no deadline
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) getterTimeoutFor(call loadOptions) time.Duration {
+	if call.timeout > 0 {
+		return call.timeout
+	}
+	return tp.getterTimeout
+}
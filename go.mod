@@ -3,7 +3,6 @@ module github.com/nuvi/go-deduplicate
 go 1.20
 
 require (
-	github.com/nuvi/go-cache v0.2.4
 	github.com/nuvi/go-dataloader v0.4.0
 	github.com/nuvi/go-dockerdb v0.0.0-20230227224549-1fcd59c208de
 	github.com/nuvi/unicycle v0.6.3
@@ -0,0 +1,166 @@
+package deduplicate
+
+import (
+	"log"
+	"time"
+
+	"github.com/nuvi/unicycle/sets"
+	"gorm.io/gorm"
+)
+
+const defaultInvalidationPollInterval = time.Second * 5
+
+// invalidation records are only needed until every pod has polled them
+const invalidationRetention = time.Hour
+
+// ids are handed out before their transactions commit, so a row can become visible after a higher id has already been polled
+// every poll therefore reads rows this recent again, and skips the ones it has already seen
+const invalidationOverlap = time.Minute
+
+// each row tells every pod to evict a key (or, when Key is empty, a whole namespace) from its in-memory caches
+type Invalidation struct {
+	ID        uint64 `gorm:"primaryKey"`
+	Namespace string `gorm:"index"`
+	Key       string
+	CreatedAt time.Time `gorm:"default:NOW();index"`
+}
+
+// Invalidate drops a key's stored result, failure and pending claim, and makes every pod evict it from memory within the invalidation poll interval
+// a getter already running for the key loses its claim, so its (possibly stale) result is dropped rather than stored
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) Invalidate(key KEY_TYPE) error {
+	err := tp.enter()
+	if err != nil {
+		return err
+	}
+	defer tp.leave()
+
+	keyStr, err := tp.getKeyStr(key)
+	if err != nil {
+		return err
+	}
+	err = tp.invalidateKeyStrs([]string{keyStr})
+	if err != nil {
+		return err
+	}
+	tp.Forget(key)
+	return nil
+}
+
+// InvalidateAll drops every stored result, failure and pending claim for this pool's getter, and makes every pod clear its in-memory caches
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) InvalidateAll() error {
+	err := tp.enter()
+	if err != nil {
+		return err
+	}
+	defer tp.leave()
+
+	err = tp.db.Transaction(func(tx *gorm.DB) error {
+		err := tp.store.deleteAll(tx)
+		if err != nil {
+			return err
+		}
+		result := tx.Where("key LIKE ?", tp.getterName+"-%").Delete(&TaskTag{})
+		if result.Error != nil {
+			return result.Error
+		}
+		return tx.Create(&Invalidation{Namespace: tp.getterName, CreatedAt: time.Now()}).Error
+	})
+	if err != nil {
+		return err
+	}
+	tp.completedCache.Clear()
+	tp.failureCache.Clear()
+	return nil
+}
+
+// Forget evicts a key from this pod's in-memory caches only; the stored result is untouched and will be loaded again from the database
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) Forget(key KEY_TYPE) {
+	tp.completedCache.Remove(key)
+	tp.failureCache.Remove(key)
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) invalidateKeyStrs(keyStrs []string) error {
+	if len(keyStrs) == 0 {
+		return nil
+	}
+	now := time.Now()
+	return tp.db.Transaction(func(tx *gorm.DB) error {
+		err := tp.store.deleteKeys(tx, keyStrs)
+		if err != nil {
+			return err
+		}
+		result := tx.Where("key IN ?", keyStrs).Delete(&TaskTag{})
+		if result.Error != nil {
+			return result.Error
+		}
+		return tp.recordInvalidations(tx, keyStrs, now)
+	})
+}
+
+// tells every pod to evict the given keys from memory the next time it polls
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) recordInvalidations(tx *gorm.DB, keyStrs []string, now time.Time) error {
+	invalidations := make([]Invalidation, len(keyStrs))
+	for i, keyStr := range keyStrs {
+		invalidations[i] = Invalidation{Namespace: tp.getterName, Key: keyStr, CreatedAt: now}
+	}
+	return tx.Create(&invalidations).Error
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) latestInvalidationID() (uint64, error) {
+	var latest uint64
+	result := tp.db.Model(&Invalidation{}).Select("COALESCE(MAX(id), 0)").Scan(&latest)
+	return latest, result.Error
+}
+
+// evicts whatever other pods (or this one) have invalidated since the last poll
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) pollInvalidations() {
+	invalidations := []Invalidation{}
+	result := tp.db.Where("namespace = ?", tp.getterName).
+		Where("id > ? OR created_at > ?", tp.lastInvalidationID, time.Now().Add(-invalidationOverlap)).
+		Order("id").
+		Find(&invalidations)
+	if result.Error != nil {
+		log.Printf("error polling invalidations: %v", result.Error)
+		return
+	}
+
+	seen := sets.Set[uint64]{}
+	keyStrs := []string{}
+	clearAll := false
+	for _, invalidation := range invalidations {
+		seen.Add(invalidation.ID)
+		if invalidation.ID > tp.lastInvalidationID {
+			tp.lastInvalidationID = invalidation.ID
+		}
+		if tp.seenInvalidations.Has(invalidation.ID) {
+			continue
+		}
+		if invalidation.Key == "" {
+			clearAll = true
+		} else {
+			keyStrs = append(keyStrs, invalidation.Key)
+		}
+	}
+	tp.seenInvalidations = seen
+
+	if clearAll {
+		tp.completedCache.Clear()
+		tp.failureCache.Clear()
+		return
+	}
+	tp.evictKeyStrs(keyStrs)
+}
+
+// memory caches are keyed by the caller's key type, so entries are matched by their canonical database key
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) evictKeyStrs(keyStrs []string) {
+	if len(keyStrs) == 0 {
+		return
+	}
+	evicted := sets.SetFromSlice(keyStrs)
+	isEvicted := func(key KEY_TYPE) bool {
+		keyStr, err := tp.getKeyStr(key)
+		return err == nil && evicted.Has(keyStr)
+	}
+	tp.completedCache.RemoveWhere(isEvicted)
+	tp.failureCache.RemoveWhere(isEvicted)
+}
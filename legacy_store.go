@@ -0,0 +1,263 @@
+package deduplicate
+
+import (
+	"time"
+
+	"github.com/nuvi/go-dataloader"
+	gormLoader "github.com/nuvi/go-dataloader/gorm"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// keeps pending claims, results and failures in the pending_tasks, completed_tasks and failed_tasks tables
+type legacyStore struct {
+	db         *gorm.DB
+	namespace  string
+	pendingTTL time.Duration
+	valueTTL   time.Duration
+	// how long past expiry a value is still served without looking any further (see WithStaleWhileRevalidate)
+	servableFor time.Duration
+
+	pendingTaskBatcher   *dataloader.QueryBatcher[string, PendingTask]
+	completedTaskBatcher *dataloader.QueryBatcher[string, CompletedTask]
+	failedTaskBatcher    *dataloader.QueryBatcher[string, FailedTask]
+}
+
+func newLegacyStore(db *gorm.DB, namespace string, pendingTTL time.Duration, valueTTL time.Duration, servableFor time.Duration, maxConcurrentBatches int, maxBatchSize int) *legacyStore {
+	return &legacyStore{
+		db:         db,
+		namespace:  namespace,
+		pendingTTL: pendingTTL,
+		valueTTL:   valueTTL,
+
+		servableFor: servableFor,
+
+		pendingTaskBatcher: dataloader.NewQueryBatcher(
+			gormLoader.GormGetter(db, "key", func(task PendingTask) string { return task.Key }),
+			maxConcurrentBatches,
+			maxBatchSize,
+		),
+		completedTaskBatcher: dataloader.NewQueryBatcher(
+			gormLoader.GormGetter(db, "key", func(task CompletedTask) string { return task.Key }),
+			maxConcurrentBatches,
+			maxBatchSize,
+		),
+		failedTaskBatcher: dataloader.NewQueryBatcher(
+			gormLoader.GormGetter(db, "key", func(task FailedTask) string { return task.Key }),
+			maxConcurrentBatches,
+			maxBatchSize,
+		),
+	}
+}
+
+func legacyModels() []any {
+	return []any{&PendingTask{}, &CompletedTask{}, &FailedTask{}}
+}
+
+// each table is a separate lookup, so this stops as soon as the rest can't matter: a servable value always wins, and nobody needs the claim behind an outcome
+func (ls *legacyStore) lookup(keyStr string, withPending bool, now time.Time) (taskRows, error) {
+	rows := taskRows{}
+	var err error
+	rows.completed, err = missingAsNil(ls.completedTaskBatcher.Load(keyStr))
+	if err != nil {
+		return taskRows{}, err
+	}
+	if rows.completed != nil && now.Before(rows.completed.expiresAt(ls.valueTTL).Add(ls.servableFor)) {
+		return rows, nil
+	}
+	rows.failed, err = missingAsNil(ls.failedTaskBatcher.Load(keyStr))
+	if err != nil {
+		return taskRows{}, err
+	}
+	if rows.failed != nil && !isLiveFailure(*rows.failed, ls.valueTTL, now) {
+		rows.failed = nil
+	}
+	if rows.failed != nil || !withPending {
+		return rows, nil
+	}
+	rows.pending, err = missingAsNil(ls.pendingTaskBatcher.Load(keyStr))
+	if err != nil {
+		return taskRows{}, err
+	}
+	return rows, nil
+}
+
+func (ls *legacyStore) getPending(keyStr string) (PendingTask, error) {
+	return ls.pendingTaskBatcher.Load(keyStr)
+}
+
+func (ls *legacyStore) claim(keyStr string, owner string, claimID string, priority Priority, now time.Time) (bool, error) {
+	result := ls.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"created_at", "owner", "claim_id", "priority", "cancelled"}),
+		Where: clause.Where{Exprs: []clause.Expression{clause.Or(
+			clause.Lt{Column: clause.Column{Table: "pending_tasks", Name: "created_at"}, Value: now.Add(-ls.pendingTTL)},
+			clause.Eq{Column: clause.Column{Table: "pending_tasks", Name: "cancelled"}, Value: true},
+		)}},
+	}).Create(&PendingTask{
+		Key:       keyStr,
+		CreatedAt: now,
+		Owner:     owner,
+		ClaimID:   claimID,
+		Priority:  priority,
+	})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (ls *legacyStore) raisePriority(keyStr string, priority Priority) error {
+	return ls.db.Model(&PendingTask{}).Where("key = ? AND priority < ?", keyStr, priority).Update("priority", priority).Error
+}
+
+func (ls *legacyStore) renew(keyStr string, claimID string, now time.Time) error {
+	return ls.db.Model(&PendingTask{}).Where("key = ? AND claim_id = ? AND NOT cancelled", keyStr, claimID).Update("created_at", now).Error
+}
+
+func (ls *legacyStore) release(keyStr string, claimID string) error {
+	return ls.db.Where("key = ? AND claim_id = ?", keyStr, claimID).Delete(&PendingTask{}).Error
+}
+
+// ends the claim first, so that a Prime or Invalidate clearing it at the same time either waits for this transaction or leaves nothing to end
+func (ls *legacyStore) endClaim(tx *gorm.DB, keyStr string, claimID string) error {
+	result := tx.Where("key = ? AND claim_id = ?", keyStr, claimID).Delete(&PendingTask{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errClaimLost
+	}
+	return nil
+}
+
+func (ls *legacyStore) releaseOwned(owner string) error {
+	return ls.db.Where("key LIKE ?", ls.namespace+"-%").Where("owner = ? AND NOT cancelled", owner).Delete(&PendingTask{}).Error
+}
+
+func (ls *legacyStore) cancel(tx *gorm.DB, keyStr string) error {
+	return tx.Model(&PendingTask{}).Where("key = ?", keyStr).Update("cancelled", true).Error
+}
+
+func (ls *legacyStore) complete(tx *gorm.DB, completedTask CompletedTask, claimID string) error {
+	err := ls.endClaim(tx, completedTask.Key, claimID)
+	if err != nil {
+		return err
+	}
+	// an expired row may still be waiting to be reaped, so replace it rather than failing on the primary key
+	result := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&completedTask)
+	if result.Error != nil {
+		return result.Error
+	}
+	// a newer value makes any earlier failure moot
+	return tx.Where("key = ?", completedTask.Key).Delete(&FailedTask{}).Error
+}
+
+func (ls *legacyStore) fail(tx *gorm.DB, failedTask FailedTask, claimID string) error {
+	err := ls.endClaim(tx, failedTask.Key, claimID)
+	if err != nil {
+		return err
+	}
+	return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&failedTask).Error
+}
+
+func (ls *legacyStore) putCompleted(tx *gorm.DB, completedTasks []CompletedTask) error {
+	keyStrs := make([]string, len(completedTasks))
+	for i, completedTask := range completedTasks {
+		keyStrs[i] = completedTask.Key
+	}
+	for _, model := range []any{&PendingTask{}, &FailedTask{}} {
+		result := tx.Where("key IN ?", keyStrs).Delete(model)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&completedTasks).Error
+}
+
+func (ls *legacyStore) putFailed(tx *gorm.DB, failedTasks []FailedTask) error {
+	keyStrs := make([]string, len(failedTasks))
+	for i, failedTask := range failedTasks {
+		keyStrs[i] = failedTask.Key
+	}
+	// a stored failure replaces the stored value rather than sitting behind it
+	for _, model := range []any{&PendingTask{}, &CompletedTask{}} {
+		result := tx.Where("key IN ?", keyStrs).Delete(model)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&failedTasks).Error
+}
+
+func (ls *legacyStore) reserve(tx *gorm.DB, keyStrs []string, now time.Time) (bool, error) {
+	pendingTasks := make([]PendingTask, len(keyStrs))
+	for i, keyStr := range keyStrs {
+		pendingTasks[i] = PendingTask{Key: keyStr, CreatedAt: now}
+	}
+	result := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"created_at", "owner", "claim_id", "priority", "cancelled"}),
+		Where: clause.Where{Exprs: []clause.Expression{clause.Or(
+			clause.Lt{Column: clause.Column{Table: "pending_tasks", Name: "created_at"}, Value: now.Add(-ls.pendingTTL)},
+			clause.Eq{Column: clause.Column{Table: "pending_tasks", Name: "cancelled"}, Value: true},
+		)}},
+	}).Create(&pendingTasks)
+	if result.Error != nil || result.RowsAffected < int64(len(keyStrs)) {
+		return false, result.Error
+	}
+	// values are only ever stored under a claim (or by a prime, which reserves first), so holding every key's claim keeps this count true until tx ends
+	var completed int64
+	result = tx.Model(&CompletedTask{}).Where("key IN ? AND expires_at > ?", keyStrs, now).Count(&completed)
+	return completed == 0, result.Error
+}
+
+func (ls *legacyStore) deleteKeys(tx *gorm.DB, keyStrs []string) error {
+	for _, model := range legacyModels() {
+		result := tx.Where("key IN ?", keyStrs).Delete(model)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+func (ls *legacyStore) deleteAll(tx *gorm.DB) error {
+	for _, model := range legacyModels() {
+		result := tx.Where("key LIKE ?", ls.namespace+"-%").Delete(model)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+func (ls *legacyStore) extendExpiry(keyStrs []string, now time.Time, until time.Time) error {
+	// rows that expired before the flush stay expired, and expiry is never moved earlier
+	return ls.db.Model(&CompletedTask{}).
+		Where("key IN ?", keyStrs).
+		Where("expires_at > ? AND expires_at < ?", now, until).
+		Update("expires_at", until).Error
+}
+
+func (ls *legacyStore) reap(now time.Time, staleRetention time.Duration) error {
+	expiredCutoff := now.Add(-ls.valueTTL)
+	// finished tasks clear their own claims, so only abandoned ones are left for here; past pendingTTL nobody waits on them any more
+	result := ls.db.Where("key LIKE ?", ls.namespace+"-%").Where("created_at < ?", now.Add(-ls.pendingTTL)).Delete(&PendingTask{})
+	if result.Error != nil {
+		return result.Error
+	}
+	// rows written before expires_at existed fall back to the pool-wide TTL, and rows that can still be served stale are kept
+	result = ls.db.Where("key LIKE ?", ls.namespace+"-%").Where("expires_at < ? OR (expires_at IS NULL AND created_at < ?)", now.Add(-staleRetention), expiredCutoff.Add(-staleRetention)).Delete(&CompletedTask{})
+	if result.Error != nil {
+		return result.Error
+	}
+	return ls.db.Where("key LIKE ?", ls.namespace+"-%").Where("expires_at < ? OR (expires_at IS NULL AND created_at < ?)", now, expiredCutoff).Delete(&FailedTask{}).Error
+}
+
+func (ls *legacyStore) hasValueSQL(keyColumn string) string {
+	return "EXISTS (SELECT 1 FROM completed_tasks WHERE completed_tasks.key = " + keyColumn + ")"
+}
+
+func (ls *legacyStore) close() {
+	ls.pendingTaskBatcher.Close()
+	ls.completedTaskBatcher.Close()
+	ls.failedTaskBatcher.Close()
+}
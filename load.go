@@ -1,102 +1,306 @@
 package deduplicate
 
 import (
+	"context"
 	"errors"
 	"time"
 
 	"github.com/nuvi/go-dataloader"
-	"github.com/nuvi/unicycle/defaults"
 )
 
 // this allows us to make sure expensive tasks are only ever run once, across all pods
-func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) Load(key KEY_TYPE) (VALUE_TYPE, error) {
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) Load(key KEY_TYPE, opts ...LoadOption) (VALUE_TYPE, error) {
+	err := tp.enter()
+	if err != nil {
+		var zero VALUE_TYPE
+		return zero, err
+	}
+	defer tp.leave()
+
+	result, err := tp.load(context.Background(), key, loadAwait, newLoadOptions(opts))
+	return result.Value, err
+}
+
+// decides what load does when the value isn't available yet
+type loadMode int
+
+const (
+	// wait on another pod's pending task, or run the getter in the foreground
+	loadAwait loadMode = iota
+	// return ErrPending right away, starting the getter in the background if nobody has
+	loadTry
+	// run the getter in the foreground, but return ErrPending rather than waiting on another pod
+	loadWork
+)
+
+// the longest a pod waiting on another pod's task goes between checks, so that outcomes (timeouts and cancellations included) reach it within a few seconds however long it has been waiting
+const maxAwaitBackoff = time.Second * 5
+
+// cancelling ctx stops a wait on another pod, but never a getter this pod has claimed, since waiting pods depend on its result
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) load(ctx context.Context, key KEY_TYPE, mode loadMode, call loadOptions) (Result[VALUE_TYPE], error) {
+	// an expired value that is only kept around in case the getter fails
+	var fallback *storedValue[VALUE_TYPE]
+
 	// check if success in memory
-	value, ok := tp.completedCache.Get(key)
+	stored, ok := tp.completedCache.Get(key)
 	if ok {
-		return value, nil
+		if tp.isServable(stored) {
+			return tp.serveStored(key, "", stored, SourceMemory), nil
+		}
+		fallback = &stored
 	}
 
 	// check if failure in memory
 	err, ok := tp.failureCache.Get(key)
-	if ok {
-		return defaults.ZeroValue[VALUE_TYPE](), err
+	if ok && (fallback != nil || tp.staleIfErrorTTL <= 0) { // otherwise the database may still have a value to fall back on
+		return tp.failWithFallback(fallback, SourceMemory, err)
 	}
 
 	// get canonical database key
 	keyStr, err := tp.getKeyStr(key)
 	if err != nil {
-		return defaults.ZeroValue[VALUE_TYPE](), err
+		return Result[VALUE_TYPE]{}, err
+	}
+
+	state, err := tp.lookupTask(keyStr, false)
+	if err != nil {
+		return Result[VALUE_TYPE]{}, err
 	}
 
 	// check if success in database
-	value, err = tp.getCompletedTask(keyStr)
-	if err == nil {
-		go tp.completedCache.Set(key, value)
-		return value, nil
-	} else if !errors.Is(err, dataloader.ErrMissingResponse) {
-		return defaults.ZeroValue[VALUE_TYPE](), err
+	if state.completed != nil {
+		tp.cacheCompleted(key, *state.completed)
+		if tp.isServable(*state.completed) {
+			return tp.serveStored(key, keyStr, *state.completed, SourceDatabase), nil
+		}
+		fallback = state.completed
 	}
 
 	// check if failure in database
-	err = tp.getFailedTask(keyStr)
-	if err != nil {
-		go tp.failureCache.Set(key, err)
-		return defaults.ZeroValue[VALUE_TYPE](), err
+	if state.failed != nil {
+		tp.failureCache.Set(key, *state.failed, state.failed.expiresAt(tp.valueTTL))
+		return tp.failWithFallback(fallback, SourceDatabase, *state.failed)
 	}
 
 	// if none of the above are true, start a new task
-	err = tp.createPendingTask(keyStr)
+	claimID, err := tp.createPendingTask(keyStr, call.priority)
 	if err != nil {
 		if errors.Is(err, errPendingStarted) { // if the task is already pending, wait on result
-			return tp.awaitPendingTask(keyStr, key)
+			if mode != loadAwait {
+				return Result[VALUE_TYPE]{}, ErrPending
+			}
+			return tp.awaitPendingTask(ctx, keyStr, key, fallback, call)
 		}
-		return defaults.ZeroValue[VALUE_TYPE](), err
+		return Result[VALUE_TYPE]{}, err
+	}
+
+	if mode == loadTry {
+		tp.goTracked(func() { _, _ = tp.compute(context.Background(), key, keyStr, claimID, fallback, call) })
+		return Result[VALUE_TYPE]{}, ErrPending
+	}
+	return tp.compute(context.Background(), key, keyStr, claimID, fallback, call)
+}
+
+// runs the getter for a task this pod has claimed, and stores the outcome
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) compute(ctx context.Context, key KEY_TYPE, keyStr string, claimID string, fallback *storedValue[VALUE_TYPE], call loadOptions) (Result[VALUE_TYPE], error) {
+	stored, err := tp.runGetter(ctx, key, keyStr, claimID, call)
+	if errors.Is(err, ErrCancelled) {
+		// the cancelled claim stays behind so that waiting pods see ErrCancelled too
+		return Result[VALUE_TYPE]{Source: SourceGetter}, err
+	} else if isUnrecordedError(err) {
+		// the getter never ran, so give up the claim and let the next caller try again
+		tp.deletePendingTask(keyStr, claimID)
+		return tp.failWithFallback(fallback, SourceGetter, err)
+	} else if err != nil {
+		completedAt := time.Now()
+		expiresAt := completedAt.Add(tp.failureTTL)
+		tp.failureCache.Set(key, err, expiresAt)
+		// the caller already gets an error, so a failure to store this one is only reported through hooks and Stats
+		_ = tp.persist(key, keyStr, claimID, func() error {
+			return tp.dropIfClaimLost(key, tp.createFailedTask(keyStr, claimID, err, completedAt, expiresAt))
+		}, call)
+		return tp.failWithFallback(fallback, SourceGetter, err)
+	} else {
+		tp.cacheCompleted(key, stored)
+		err = tp.persist(key, keyStr, claimID, func() error {
+			return tp.dropIfClaimLost(key, tp.createCompletedTask(key, keyStr, claimID, stored))
+		}, call)
+		return stored.result(SourceGetter), err
 	}
+}
 
-	value, err = tp.getter(key)
+// reports why ctx ended (for example ErrCancelled) in place of the bare context error it caused
+func causeOf(ctx context.Context, err error) error {
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
+// errors that say nothing about the key itself, and so are never cached as failures
+// context errors aren't among them: once the getter's own context ends, runGetter reports why it ended instead, and any other context error is the getter's own failure
+func isUnrecordedError(err error) bool {
+	return errors.Is(err, ErrOverloaded) ||
+		errors.Is(err, ErrClosed) ||
+		errors.Is(err, ErrCircuitOpen) ||
+		errors.Is(err, ErrConcurrencyLimited) ||
+		errors.Is(err, ErrRateLimited)
+}
+
+// waits for capacity, then calls the getter and records how long it took, and how long its value should live
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) runGetter(ctx context.Context, key KEY_TYPE, keyStr string, claimID string, call loadOptions) (storedValue[VALUE_TYPE], error) {
+	getterCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	stopWatching := tp.watchCancellation(keyStr, claimID, cancel)
+	defer stopWatching()
+	stopHolding := tp.holdPendingTask(keyStr, claimID)
+	defer stopHolding()
+
+	probe, err := tp.enterCircuit()
 	if err != nil {
-		go tp.failureCache.Set(key, err)
-		go tp.createFailedTask(keyStr, err)
-		return defaults.ZeroValue[VALUE_TYPE](), err
+		return storedValue[VALUE_TYPE]{}, err
+	}
+	// Close interrupts waits for capacity, though not a getter that has started
+	waitCtx, stopWaiting := tp.untilClosing(getterCtx)
+	defer stopWaiting()
+	releaseTurn, err := tp.inFlightLimit.acquire(waitCtx, call.priority)
+	if err != nil {
+		tp.abandonProbe(probe)
+		return storedValue[VALUE_TYPE]{}, causeOf(waitCtx, err)
+	}
+	err = tp.takeRateLimitToken(waitCtx, call)
+	if err != nil {
+		releaseTurn()
+		tp.abandonProbe(probe)
+		return storedValue[VALUE_TYPE]{}, causeOf(waitCtx, err)
+	}
+	releaseSlot, err := tp.acquireGetterSlot(waitCtx, keyStr, call.priority)
+	if err != nil {
+		releaseTurn()
+		tp.abandonProbe(probe)
+		return storedValue[VALUE_TYPE]{}, causeOf(waitCtx, err)
+	}
+	stopWaiting()
+	stopHolding()
+
+	if timeout := tp.getterTimeoutFor(call); timeout > 0 {
+		timer := time.AfterFunc(timeout, func() { cancel(GetterTimeoutError{Timeout: timeout}) })
+		defer timer.Stop()
+	}
+
+	type getterResult struct {
+		value VALUE_TYPE
+		ttl   time.Duration
+		err   error
+	}
+	done := make(chan getterResult, 1)
+	startedAt := time.Now()
+	// getters that ignore their context can outlive a timeout, so they keep their turn and slot until they actually return
+	go func() {
+		defer releaseTurn()
+		defer releaseSlot()
+		value, ttl, err := tp.getter(getterCtx, key)
+		done <- getterResult{value: value, ttl: ttl, err: err}
+	}()
+
+	var result getterResult
+	select {
+	case result = <-done:
+	case <-getterCtx.Done():
+		select {
+		case result = <-done:
+		default:
+			result.err = context.Cause(getterCtx)
+		}
+	}
+	completedAt := time.Now()
+	if result.err != nil {
+		// a getter that gave up because its context ended failed for the reason it ended (a timeout or Cancel), not with the bare context error
+		result.err = causeOf(getterCtx, result.err)
+	}
+	if result.err == nil || countsAgainstCircuit(result.err) {
+		tp.recordCircuit(result.err != nil, probe)
+	} else {
+		tp.abandonProbe(probe)
+	}
+	if result.err != nil {
+		return storedValue[VALUE_TYPE]{}, result.err
+	}
+	return storedValue[VALUE_TYPE]{
+		value:          result.value,
+		createdAt:      completedAt,
+		expiresAt:      completedAt.Add(tp.entryTTL(key, result.value, result.ttl)),
+		computedBy:     tp.podID,
+		getterDuration: completedAt.Sub(startedAt),
+	}, nil
+}
+
+// fresh values extend their sliding expiration and count towards refresh-ahead, while stale ones are returned as-is and trigger a background refresh
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) serveStored(key KEY_TYPE, keyStr string, stored storedValue[VALUE_TYPE], source Source) Result[VALUE_TYPE] {
+	tp.recordRead(key)
+	if stored.isFresh() {
+		tp.touch(key, keyStr, stored)
 	} else {
-		go tp.completedCache.Set(key, value)
-		go tp.createCompletedTask(keyStr, value)
-		return value, nil
+		go tp.revalidate(key, keyStr, time.Now())
 	}
+	return stored.result(source)
 }
 
-func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) awaitPendingTask(keyStr string, key KEY_TYPE) (VALUE_TYPE, error) {
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) awaitPendingTask(ctx context.Context, keyStr string, key KEY_TYPE, fallback *storedValue[VALUE_TYPE], call loadOptions) (Result[VALUE_TYPE], error) {
 	pendingTask, err := tp.getPendingTask(keyStr)
-	if err != nil {
-		return defaults.ZeroValue[VALUE_TYPE](), err
+	if errors.Is(err, dataloader.ErrMissingResponse) { // the claim was already finished or given up
+		return tp.load(ctx, key, loadAwait, call)
+	} else if err != nil {
+		return Result[VALUE_TYPE]{}, err
 	}
 
+	tp.raisePendingTaskPriority(pendingTask, call.priority)
+
 	backoff := time.Second
 
 	for {
+		if pendingTask.Cancelled {
+			return Result[VALUE_TYPE]{Source: SourceAwaited}, ErrCancelled
+		}
 		// check if pending task expired
 		if pendingTask.isExpired(tp.pendingTTL) {
-			return defaults.ZeroValue[VALUE_TYPE](), errPendingTimeout
+			return tp.failWithFallback(fallback, SourceAwaited, errPendingTimeout)
 		}
 
 		// exponential backoff before next database check
-		time.Sleep(backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return Result[VALUE_TYPE]{Source: SourceAwaited}, ctx.Err()
+		case <-tp.closing:
+			return Result[VALUE_TYPE]{Source: SourceAwaited}, ErrClosed
+		}
 		backoff *= 2
+		if backoff > maxAwaitBackoff {
+			backoff = maxAwaitBackoff
+		}
+
+		state, err := tp.lookupTask(keyStr, true)
+		if err != nil {
+			return Result[VALUE_TYPE]{}, err
+		}
 
 		// check if success in database
-		value, err := tp.getCompletedTask(keyStr)
-		if err == nil {
-			go tp.completedCache.Set(key, value)
-			return value, nil
-		} else if !errors.Is(err, dataloader.ErrMissingResponse) {
-			return defaults.ZeroValue[VALUE_TYPE](), err
+		if state.completed != nil && state.completed.isFresh() {
+			tp.cacheCompleted(key, *state.completed)
+			return state.completed.result(SourceAwaited), nil
 		}
 
 		// check if failure in database
-		err = tp.getFailedTask(keyStr)
-		if err != nil {
-			go tp.failureCache.Set(key, err)
-			return defaults.ZeroValue[VALUE_TYPE](), err
+		if state.failed != nil {
+			tp.failureCache.Set(key, *state.failed, state.failed.expiresAt(tp.valueTTL))
+			return tp.failWithFallback(fallback, SourceAwaited, *state.failed)
+		}
+
+		// if the claim was given up without a result (for example because the getter couldn't get capacity), try to take it over
+		if state.pending == nil {
+			return tp.load(ctx, key, loadAwait, call)
 		}
+		pendingTask = *state.pending
 	}
 }
@@ -0,0 +1,79 @@
+package deduplicate
+
+import (
+	"strconv"
+	"time"
+)
+
+// how urgently a task should run when the getter's capacity is limited; higher runs first
+type Priority int
+
+const (
+	PriorityLow    Priority = -10
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 10
+)
+
+const defaultPriorityAging = time.Minute
+
+// a LoadOption configures a single call to Load, LoadWithMeta, TryLoad, Watch or Enqueue
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	priority Priority
+	// overrides the pool's RateLimit.Wait when set
+	rateLimitWait *bool
+	timeout       time.Duration
+	writeThrough  bool
+}
+
+func newLoadOptions(opts []LoadOption) loadOptions {
+	call := loadOptions{priority: PriorityNormal}
+	for _, opt := range opts {
+		opt(&call)
+	}
+	return call
+}
+
+// WithPriority sets the priority the task is queued or claimed with (PriorityNormal by default)
+func WithPriority(priority Priority) LoadOption {
+	return func(call *loadOptions) {
+		call.priority = priority
+	}
+}
+
+// WithRateLimitWait chooses whether this call waits for a rate limit token or fails right away with a RateLimitedError, overriding the pool's RateLimit.Wait
+func WithRateLimitWait(wait bool) LoadOption {
+	return func(call *loadOptions) {
+		call.rateLimitWait = &wait
+	}
+}
+
+// WithTimeout bounds how long the getter may run for this call, overriding WithGetterTimeout
+// it only applies when this call ends up running the getter; waiting on another pod is still bounded by pendingTTL
+func WithTimeout(timeout time.Duration) LoadOption {
+	return func(call *loadOptions) {
+		call.timeout = timeout
+	}
+}
+
+// WithDurableWrite makes this call store its result before returning, as WithWriteThrough does for the whole pool
+func WithDurableWrite() LoadOption {
+	return func(call *loadOptions) {
+		call.writeThrough = true
+	}
+}
+
+// orders rows with priority and created_at columns by how urgent they are now, optionally qualified by a table name or alias
+// waiting raises a task's priority by one every aging interval, so low priority work can't starve
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) effectivePrioritySQL(table string) string {
+	prefix := ""
+	if table != "" {
+		prefix = table + "."
+	}
+	return "(" + prefix + "priority + EXTRACT(EPOCH FROM (NOW() - " + prefix + "created_at)) / " + formatSeconds(tp.priorityAging) + ")"
+}
+
+func formatSeconds(duration time.Duration) string {
+	return strconv.FormatFloat(duration.Seconds(), 'f', -1, 64)
+}
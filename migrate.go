@@ -0,0 +1,157 @@
+package deduplicate
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// the table recording which migrations have run; it has its own name so it can't clash with another tool's
+const migrationsTable = "deduplicate_schema_migrations"
+
+// ErrSchemaMissing is returned by NewTaskPool with WithoutAutoMigrate when the database is missing tables, columns or indexes the pool needs
+var ErrSchemaMissing = errors.New("database schema is missing or out of date")
+
+// lists what the database is missing; run Migrate (or apply the files in migrations/) to fix it
+type SchemaError struct {
+	Missing []string
+}
+
+func (se SchemaError) Error() string {
+	return fmt.Sprintf("%v, run deduplicate.Migrate or the SQL files in migrations/: missing %s", ErrSchemaMissing, strings.Join(se.Missing, ", "))
+}
+
+func (se SchemaError) Unwrap() error {
+	return ErrSchemaMissing
+}
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// reads the embedded migrations in version order; file names start with their version, as in 0001_task_tables.sql
+func migrations() ([]migration, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	toReturn := make([]migration, 0, len(names))
+	for _, name := range names {
+		base := strings.TrimPrefix(name, "migrations/")
+		version, err := strconv.Atoi(strings.SplitN(base, "_", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no version: %w", base, err)
+		}
+		contents, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		toReturn = append(toReturn, migration{version: version, name: base, sql: string(contents)})
+	}
+	sort.Slice(toReturn, func(i, j int) bool { return toReturn[i].version < toReturn[j].version })
+	return toReturn, nil
+}
+
+// Migrate brings the database up to date with every table and index any pool needs (including the WithUnifiedSchema one), applying the versioned SQL files in migrations/ that haven't run yet
+// it is safe to run from several pods at once, and on databases NewTaskPool has already migrated; run it from a deploy job and create pools WithoutAutoMigrate where application roles can't run DDL
+func Migrate(db *gorm.DB) error {
+	toApply, err := migrations()
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		// pods migrating at the same time take turns, and later ones find nothing left to do
+		result := tx.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", migrationsTable)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Exec("CREATE TABLE IF NOT EXISTS " + migrationsTable + " (version bigint PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL DEFAULT NOW())")
+		if result.Error != nil {
+			return result.Error
+		}
+		applied := []int{}
+		result = tx.Table(migrationsTable).Pluck("version", &applied)
+		if result.Error != nil {
+			return result.Error
+		}
+		isApplied := map[int]bool{}
+		for _, version := range applied {
+			isApplied[version] = true
+		}
+		for _, migration := range toApply {
+			if isApplied[migration.version] {
+				continue
+			}
+			result = tx.Exec(migration.sql)
+			if result.Error != nil {
+				return fmt.Errorf("applying migration %s: %w", migration.name, result.Error)
+			}
+			result = tx.Exec("INSERT INTO "+migrationsTable+" (version, name) VALUES (?, ?)", migration.version, migration.name)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		return nil
+	})
+}
+
+// every model a pool needs, for the task schema it uses
+func poolModels(unifiedSchema bool) []any {
+	models := legacyModels()
+	if unifiedSchema {
+		models = unifiedModels()
+	}
+	return append(
+		models,
+		&Invalidation{},
+		&TaskTag{},
+		&QueuedTask{},
+		&GetterSlot{},
+		&GetterSlotWaiter{},
+		&RateLimitBucket{},
+		&CircuitBreakerState{},
+	)
+}
+
+// makes sure every table, column and index the models need exists, without changing anything
+func checkSchema(db *gorm.DB, models []any) error {
+	migrator := db.Migrator()
+	missing := []string{}
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+		err := stmt.Parse(model)
+		if err != nil {
+			return err
+		}
+		table := stmt.Schema.Table
+		if !migrator.HasTable(model) {
+			missing = append(missing, "table "+table)
+			continue
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !migrator.HasColumn(model, field.DBName) {
+				missing = append(missing, "column "+table+"."+field.DBName)
+			}
+		}
+		for _, index := range stmt.Schema.ParseIndexes() {
+			if !migrator.HasIndex(model, index.Name) {
+				missing = append(missing, "index "+index.Name)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return SchemaError{Missing: missing}
+	}
+	return nil
+}
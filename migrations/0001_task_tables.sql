@@ -0,0 +1,17 @@
+-- the tables every pool on the default schema keeps its pending claims, results and failures in
+CREATE TABLE IF NOT EXISTS pending_tasks (
+	key text PRIMARY KEY,
+	created_at timestamptz DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS completed_tasks (
+	key text PRIMARY KEY,
+	created_at timestamptz DEFAULT NOW(),
+	value text
+);
+
+CREATE TABLE IF NOT EXISTS failed_tasks (
+	key text PRIMARY KEY,
+	created_at timestamptz DEFAULT NOW(),
+	error_string text
+);
@@ -0,0 +1,13 @@
+-- per-entry expiry, provenance, claim ownership, priorities, cancellation and timeouts
+ALTER TABLE pending_tasks ADD COLUMN IF NOT EXISTS owner text;
+ALTER TABLE pending_tasks ADD COLUMN IF NOT EXISTS priority bigint;
+ALTER TABLE pending_tasks ADD COLUMN IF NOT EXISTS cancelled boolean;
+
+ALTER TABLE completed_tasks ADD COLUMN IF NOT EXISTS expires_at timestamptz;
+ALTER TABLE completed_tasks ADD COLUMN IF NOT EXISTS computed_by text;
+ALTER TABLE completed_tasks ADD COLUMN IF NOT EXISTS getter_duration bigint;
+CREATE INDEX IF NOT EXISTS idx_completed_tasks_expires_at ON completed_tasks (expires_at);
+
+ALTER TABLE failed_tasks ADD COLUMN IF NOT EXISTS expires_at timestamptz;
+ALTER TABLE failed_tasks ADD COLUMN IF NOT EXISTS timed_out boolean;
+CREATE INDEX IF NOT EXISTS idx_failed_tasks_expires_at ON failed_tasks (expires_at);
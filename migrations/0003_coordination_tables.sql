@@ -0,0 +1,65 @@
+-- invalidations, tags, the work queue, getter slots, rate limits and circuit breakers, all shared across pods
+CREATE TABLE IF NOT EXISTS invalidations (
+	id bigserial PRIMARY KEY,
+	namespace text,
+	key text,
+	created_at timestamptz DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_invalidations_namespace ON invalidations (namespace);
+CREATE INDEX IF NOT EXISTS idx_invalidations_created_at ON invalidations (created_at);
+
+CREATE TABLE IF NOT EXISTS task_tags (
+	key text,
+	tag text,
+	PRIMARY KEY (key, tag)
+);
+CREATE INDEX IF NOT EXISTS idx_task_tags_tag ON task_tags (tag);
+
+CREATE TABLE IF NOT EXISTS queued_tasks (
+	key text PRIMARY KEY,
+	namespace text,
+	created_at timestamptz DEFAULT NOW(),
+	payload text,
+	priority bigint
+);
+CREATE INDEX IF NOT EXISTS idx_queued_tasks_namespace ON queued_tasks (namespace);
+CREATE INDEX IF NOT EXISTS idx_queued_tasks_created_at ON queued_tasks (created_at);
+CREATE INDEX IF NOT EXISTS idx_queued_tasks_priority ON queued_tasks (priority);
+
+CREATE TABLE IF NOT EXISTS getter_slots (
+	namespace text,
+	slot bigint,
+	owner text,
+	expires_at timestamptz,
+	PRIMARY KEY (namespace, slot)
+);
+CREATE INDEX IF NOT EXISTS idx_getter_slots_expires_at ON getter_slots (expires_at);
+
+CREATE TABLE IF NOT EXISTS getter_slot_waiters (
+	id bigserial PRIMARY KEY,
+	namespace text,
+	priority bigint,
+	created_at timestamptz DEFAULT NOW(),
+	heartbeat_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_getter_slot_waiters_namespace ON getter_slot_waiters (namespace);
+CREATE INDEX IF NOT EXISTS idx_getter_slot_waiters_heartbeat_at ON getter_slot_waiters (heartbeat_at);
+
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+	namespace text PRIMARY KEY,
+	tokens decimal,
+	refilled_at timestamptz,
+	day text,
+	day_count bigint
+);
+
+CREATE TABLE IF NOT EXISTS circuit_breaker_states (
+	namespace text PRIMARY KEY,
+	state bigint,
+	changed_at timestamptz,
+	window_start timestamptz,
+	requests bigint,
+	failures bigint,
+	probes bigint,
+	successes bigint
+);
@@ -0,0 +1,21 @@
+-- the single-table schema used by pools created with WithUnifiedSchema
+CREATE TABLE IF NOT EXISTS tasks (
+	key text PRIMARY KEY,
+	state text,
+	owner text,
+	claimed_at timestamptz,
+	priority bigint,
+	cancelled boolean,
+	attempts bigint,
+	value_expires_at timestamptz,
+	value_created_at timestamptz,
+	value text,
+	computed_by text,
+	getter_duration bigint,
+	failure_expires_at timestamptz,
+	failed_at timestamptz,
+	error_string text,
+	timed_out boolean
+);
+CREATE INDEX IF NOT EXISTS idx_tasks_value_expires_at ON tasks (value_expires_at);
+CREATE INDEX IF NOT EXISTS idx_tasks_failure_expires_at ON tasks (failure_expires_at);
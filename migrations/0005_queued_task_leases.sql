@@ -0,0 +1,3 @@
+-- queued tasks stay in the queue, leased to the worker computing them, until their key is done
+ALTER TABLE queued_tasks ADD COLUMN IF NOT EXISTS leased_until timestamptz;
+CREATE INDEX IF NOT EXISTS idx_queued_tasks_leased_until ON queued_tasks (leased_until);
@@ -0,0 +1,3 @@
+-- every claim gets its own ID, so an outcome is only stored under the claim it was computed for
+ALTER TABLE pending_tasks ADD COLUMN IF NOT EXISTS claim_id text;
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS claim_id text;
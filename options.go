@@ -0,0 +1,259 @@
+package deduplicate
+
+import (
+	"fmt"
+	"time"
+)
+
+// an Option configures optional TaskPool behaviour when the pool is constructed
+type Option func(*options)
+
+type options struct {
+	// generic hooks are stored untyped here so that Option doesn't need type parameters, and are checked against the pool's types in NewTaskPool
+	ttlFunc  any
+	tagsFunc any
+
+	slidingTTL           time.Duration
+	slidingFlushInterval time.Duration
+
+	staleTTL time.Duration
+
+	failureTTL      time.Duration
+	staleIfErrorTTL time.Duration
+
+	refreshAheadWindow        time.Duration
+	refreshAheadMinReads      int
+	refreshAheadMaxConcurrent int
+
+	invalidationPollInterval time.Duration
+
+	primePolicy PrimePolicy
+
+	podID string
+
+	workers            int
+	workerPollInterval time.Duration
+
+	priorityAging time.Duration
+
+	concurrencyLimit   int
+	concurrencyMaxWait time.Duration
+
+	rateLimit *RateLimit
+
+	maxInFlight int
+	maxQueued   int
+
+	getterTimeout time.Duration
+
+	circuitBreaker *CircuitBreaker
+
+	writeQueueSize     int
+	writeWorkers       int
+	writeMaxAttempts   int
+	writeBackoff       time.Duration
+	writeThrough       bool
+	persistFailureHook any
+
+	unifiedSchema bool
+
+	skipAutoMigrate bool
+}
+
+// WithTTLFunc lets each completed value decide how long it lives (for example based on a vendor's Cache-Control header)
+// a non-positive duration falls back to the pool's valueTTL
+func WithTTLFunc[KEY_TYPE comparable, VALUE_TYPE any](ttlFunc func(KEY_TYPE, VALUE_TYPE) time.Duration) Option {
+	return func(opts *options) {
+		opts.ttlFunc = ttlFunc
+	}
+}
+
+// WithTagsFunc attaches tags to each completed value, so that related results can be dropped together with InvalidateTag
+func WithTagsFunc[KEY_TYPE comparable, VALUE_TYPE any](tagsFunc func(KEY_TYPE, VALUE_TYPE) []string) Option {
+	return func(opts *options) {
+		opts.tagsFunc = tagsFunc
+	}
+}
+
+// WithSlidingExpiration keeps values that are being read alive: every read through Load pushes the value's expiry back to at least ttl from now
+// extensions are collected in memory and written to the database in batches every flushInterval (ttl/10 if not positive), so reads don't turn into writes
+func WithSlidingExpiration(ttl time.Duration, flushInterval time.Duration) Option {
+	return func(opts *options) {
+		opts.slidingTTL = ttl
+		opts.slidingFlushInterval = flushInterval
+	}
+}
+
+// WithStaleWhileRevalidate keeps serving a value for up to staleTTL after it expires
+// the first read of a stale value starts a single background refresh across all pods, and the refreshed value replaces the old one once it is stored
+func WithStaleWhileRevalidate(staleTTL time.Duration) Option {
+	return func(opts *options) {
+		opts.staleTTL = staleTTL
+	}
+}
+
+// WithFailureTTL sets how long a getter error is cached before the key is retried (valueTTL by default)
+func WithFailureTTL(failureTTL time.Duration) Option {
+	return func(opts *options) {
+		opts.failureTTL = failureTTL
+	}
+}
+
+// WithStaleIfError keeps expired values for up to grace after they expire, and serves them when the getter fails instead of returning the error
+// the stale value is returned together with a StaleError, and the failure is still recorded so the key is retried once it expires (see WithFailureTTL)
+func WithStaleIfError(grace time.Duration) Option {
+	return func(opts *options) {
+		opts.staleIfErrorTTL = grace
+	}
+}
+
+// WithRefreshAhead recomputes hot keys before they expire, so readers of popular values never see a miss
+// once per window, every key this pod served at least minReads times during the window and that expires before the next window is refreshed, at most maxConcurrent at a time
+// refreshes claim the key like any other task, so a key is only refreshed by one pod
+func WithRefreshAhead(window time.Duration, minReads int, maxConcurrent int) Option {
+	return func(opts *options) {
+		opts.refreshAheadWindow = window
+		opts.refreshAheadMinReads = minReads
+		opts.refreshAheadMaxConcurrent = maxConcurrent
+	}
+}
+
+// WithInvalidationPollInterval bounds how long other pods keep serving a value from memory after it is invalidated (5 seconds by default)
+func WithInvalidationPollInterval(interval time.Duration) Option {
+	return func(opts *options) {
+		opts.invalidationPollInterval = interval
+	}
+}
+
+// WithPrimePolicy decides whether Prime and PrimeError overwrite existing results and pending claims (the default) or fail with ErrAlreadyExists
+func WithPrimePolicy(policy PrimePolicy) Option {
+	return func(opts *options) {
+		opts.primePolicy = policy
+	}
+}
+
+// WithPodID sets the name this pod records on the work it does (the hostname plus a random suffix by default)
+func WithPodID(podID string) Option {
+	return func(opts *options) {
+		opts.podID = podID
+	}
+}
+
+// WithWorkers starts count workers on this pod that compute keys passed to Enqueue, checking for new work every pollInterval (1 second by default)
+// queued keys are claimed with SELECT ... FOR UPDATE SKIP LOCKED, so work is spread across every pod running workers
+func WithWorkers(count int, pollInterval time.Duration) Option {
+	return func(opts *options) {
+		opts.workers = count
+		opts.workerPollInterval = pollInterval
+	}
+}
+
+// WithPriorityAging sets how long a waiting task takes to gain one level of priority (1 minute by default), so that low priority work is never starved
+func WithPriorityAging(aging time.Duration) Option {
+	return func(opts *options) {
+		opts.priorityAging = aging
+	}
+}
+
+// WithConcurrencyLimit caps how many getters run at once across every pod sharing the database
+// callers wait for a free slot, higher priorities first, for up to maxWait before failing with ErrConcurrencyLimited; a negative maxWait waits indefinitely, and zero fails right away
+// slots are leased for pendingTTL and renewed while the getter runs, so a crashed pod's slots free up on their own
+func WithConcurrencyLimit(limit int, maxWait time.Duration) Option {
+	return func(opts *options) {
+		opts.concurrencyLimit = limit
+		opts.concurrencyMaxWait = maxWait
+	}
+}
+
+// WithRateLimit limits how often the getter is called across every pod sharing the database, using a token bucket and an optional daily quota
+// rate limited calls either wait for a token or fail with a RateLimitedError, depending on limit.Wait (overridable per call with WithRateLimitWait)
+func WithRateLimit(limit RateLimit) Option {
+	return func(opts *options) {
+		opts.rateLimit = &limit
+	}
+}
+
+// WithMaxInFlight caps how many getters this pod runs at once, so a burst of unique keys can't exhaust memory or upstream connections
+// up to maxQueued further callers wait for a turn, higher priorities first; beyond that, calls fail right away with ErrOverloaded
+func WithMaxInFlight(maxInFlight int, maxQueued int) Option {
+	return func(opts *options) {
+		opts.maxInFlight = maxInFlight
+		opts.maxQueued = maxQueued
+	}
+}
+
+// WithGetterTimeout bounds how long the getter may run; past it, the getter's context is cancelled and a GetterTimeoutError is recorded like any other failure
+// getters that don't take a context are abandoned rather than stopped, but still hold their place under WithMaxInFlight and WithConcurrencyLimit until they return
+func WithGetterTimeout(timeout time.Duration) Option {
+	return func(opts *options) {
+		opts.getterTimeout = timeout
+	}
+}
+
+// WithCircuitBreaker stops calling the getter once too many calls fail, so callers fail fast with ErrCircuitOpen instead of waiting on a broken upstream
+// the breaker's state is shared by every pod using the database; zero fields take their documented defaults
+func WithCircuitBreaker(breaker CircuitBreaker) Option {
+	return func(opts *options) {
+		breaker = breaker.withDefaults()
+		opts.circuitBreaker = &breaker
+	}
+}
+
+// WithWriteBehind sizes the queue of results waiting to be stored (1000 by default) and how many workers store them (4 by default)
+// when the queue is full, the caller stores its own result before returning
+func WithWriteBehind(queueSize int, workers int) Option {
+	return func(opts *options) {
+		opts.writeQueueSize = queueSize
+		opts.writeWorkers = workers
+	}
+}
+
+// WithWriteRetries sets how many times storing a result is attempted (5 by default), and the backoff before the first retry (100ms by default), which doubles after each one
+func WithWriteRetries(maxAttempts int, backoff time.Duration) Option {
+	return func(opts *options) {
+		opts.writeMaxAttempts = maxAttempts
+		opts.writeBackoff = backoff
+	}
+}
+
+// WithWriteThrough stores every result before Load returns; if it can't be stored, Load returns a PersistError alongside the computed value
+func WithWriteThrough() Option {
+	return func(opts *options) {
+		opts.writeThrough = true
+	}
+}
+
+// WithPersistFailureHook is called after every failed attempt to store a result, for alerting or metrics
+func WithPersistFailureHook[KEY_TYPE comparable](hook func(PersistFailure[KEY_TYPE])) Option {
+	return func(opts *options) {
+		opts.persistFailureHook = hook
+	}
+}
+
+// WithUnifiedSchema keeps each key's pending claim, value and failure in one row of the tasks table instead of three separate tables, so a miss costs one lookup instead of three
+// every pool sharing a getter must use the same schema; see MigrateToUnifiedSchema for moving existing rows over
+func WithUnifiedSchema() Option {
+	return func(opts *options) {
+		opts.unifiedSchema = true
+	}
+}
+
+// WithoutAutoMigrate stops NewTaskPool from creating or altering tables; it only checks that everything it needs exists, and fails with a SchemaError otherwise
+// use it where application roles can't run DDL, or to keep pods from racing each other's AutoMigrate, and run Migrate (or the SQL files in migrations/) from a deploy job instead
+func WithoutAutoMigrate() Option {
+	return func(opts *options) {
+		opts.skipAutoMigrate = true
+	}
+}
+
+func typedHook[HOOK_TYPE any](name string, hook any) (HOOK_TYPE, error) {
+	var typed HOOK_TYPE
+	if hook == nil {
+		return typed, nil
+	}
+	typed, ok := hook.(HOOK_TYPE)
+	if !ok {
+		return typed, fmt.Errorf("%s has type %T, which doesn't match the pool's key and value types (expected %T)", name, hook, typed)
+	}
+	return typed, nil
+}
@@ -1,14 +1,22 @@
 package deduplicate
 
 import (
+	"context"
 	"errors"
-	"strings"
+	"log"
 	"time"
 )
 
 type PendingTask struct {
 	Key       string    `gorm:"primaryKey"`
 	CreatedAt time.Time `gorm:"default:NOW()"`
+	// the pod ID of the pod running the getter
+	Owner string
+	// changes every time the key is claimed
+	ClaimID  string
+	Priority Priority
+	// set by Cancel; the owning pod stops its getter, and the claim can be taken over straight away
+	Cancelled bool
 }
 
 func (pt PendingTask) isExpired(ttl time.Duration) bool {
@@ -18,20 +26,85 @@ func (pt PendingTask) isExpired(ttl time.Duration) bool {
 var errPendingTimeout = errors.New("pending task timed out")
 var errPendingStarted = errors.New("this task has already been started")
 
+// returned when storing the outcome of a claim that was since primed over, invalidated or taken over; the outcome is stale, so it's dropped
+var errClaimLost = errors.New("pending task was cleared or claimed again")
+
 func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) getPendingTask(keyStr string) (PendingTask, error) {
-	return tp.pendingTaskBatcher.Load(keyStr)
+	return tp.store.getPending(keyStr)
+}
+
+// claims the task for this pod and returns the claim's ID; a claim that has outlived pendingTTL (for example because its pod crashed) or was cancelled is taken over rather than waited on
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) createPendingTask(keyStr string, priority Priority) (string, error) {
+	claimID := newClaimID()
+	claimed, err := tp.store.claim(keyStr, tp.podID, claimID, priority, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if !claimed {
+		return "", errPendingStarted
+	}
+	return claimID, nil
+}
+
+// a caller waiting on a claim passes its priority on, so the pod running the task gets a getter slot just as soon as the caller would have
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) raisePendingTaskPriority(pendingTask PendingTask, priority Priority) {
+	if pendingTask.Cancelled || pendingTask.Priority >= priority {
+		return
+	}
+	err := tp.store.raisePriority(pendingTask.Key, priority)
+	if err != nil {
+		log.Println(err)
+	}
 }
 
-func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) createPendingTask(keyStr string) error {
-	result := tp.db.Create(&PendingTask{
-		Key:       keyStr,
-		CreatedAt: time.Now(),
-	})
-	if result.Error != nil {
-		if strings.Contains(result.Error.Error(), "duplicate key value violates unique constraint") {
-			return errPendingStarted
+// renews this pod's claim on the task every third of pendingTTL until the returned function is called, so waiting for capacity doesn't let another pod take it over
+// the returned function renews it one last time if the wait was long, so the getter starts with the whole of pendingTTL; the getter itself gets no renewals, so a hung getter's claim still expires
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) holdPendingTask(keyStr string, claimID string) func() {
+	startedAt := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(tp.pendingTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := tp.store.renew(keyStr, claimID, time.Now())
+				if err != nil {
+					log.Printf("error renewing pending task: %v", err)
+				}
+			case <-ctx.Done():
+				return
+			}
 		}
-		return result.Error
+	}()
+	return func() {
+		if ctx.Err() != nil {
+			return
+		}
+		cancel()
+		if time.Since(startedAt) < tp.pendingTTL/3 {
+			return
+		}
+		err := tp.store.renew(keyStr, claimID, time.Now())
+		if err != nil {
+			log.Printf("error renewing pending task: %v", err)
+		}
+	}
+}
+
+// gives up a claim on the task; a claim that has since been taken over is left alone
+// outcomes of lost claims are dropped rather than retried, along with this pod's in-memory copy, so the next read picks up whatever replaced them
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) dropIfClaimLost(key KEY_TYPE, err error) error {
+	if errors.Is(err, errClaimLost) {
+		tp.Forget(key)
+		return nil
+	}
+	return err
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) deletePendingTask(keyStr string, claimID string) {
+	err := tp.store.release(keyStr, claimID)
+	if err != nil {
+		log.Println(err)
 	}
-	return nil
 }
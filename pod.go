@@ -0,0 +1,25 @@
+package deduplicate
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+)
+
+// identifies this process in stored rows; the random suffix keeps restarted pods with the same hostname apart
+func defaultPodID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return hostname + "-" + hex.EncodeToString(suffix)
+}
+
+// identifies one claim on a key, so that a pod only ever finishes or gives up the claim it took, and never a later one on the same key
+func newClaimID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,158 @@
+package deduplicate
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// decides what Prime and PrimeError do when a key already has a live result or pending claim
+type PrimePolicy int
+
+const (
+	// replace whatever is there; other pods drop their in-memory copies within the invalidation poll interval
+	PrimeOverwrite PrimePolicy = iota
+	// leave existing results and claims alone and return ErrAlreadyExists
+	PrimeFailIfExists
+)
+
+var ErrAlreadyExists = errors.New("a result or pending task already exists for this key")
+
+// Prime stores a value computed elsewhere (for example pushed by a webhook), so later loads use it without calling the getter
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) Prime(key KEY_TYPE, value VALUE_TYPE) error {
+	return tp.PrimeMany(map[KEY_TYPE]VALUE_TYPE{key: value})
+}
+
+// PrimeMany is the bulk version of Prime; with PrimeFailIfExists, nothing is stored if any key already exists
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) PrimeMany(values map[KEY_TYPE]VALUE_TYPE) error {
+	err := tp.enter()
+	if err != nil {
+		return err
+	}
+	defer tp.leave()
+
+	now := time.Now()
+	keyStrs := make([]string, 0, len(values))
+	completedTasks := make([]CompletedTask, 0, len(values))
+	stored := make(map[KEY_TYPE]storedValue[VALUE_TYPE], len(values))
+	tags := make(map[string][]string, len(values))
+	for key, value := range values {
+		keyStr, err := tp.getKeyStr(key)
+		if err != nil {
+			return err
+		}
+		bytes, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		expiresAt := now.Add(tp.entryTTL(key, value, 0))
+		keyStrs = append(keyStrs, keyStr)
+		completedTasks = append(completedTasks, CompletedTask{
+			Key:        keyStr,
+			CreatedAt:  now,
+			ExpiresAt:  expiresAt,
+			Value:      string(bytes),
+			ComputedBy: tp.podID,
+		})
+		stored[key] = storedValue[VALUE_TYPE]{value: value, createdAt: now, expiresAt: expiresAt, computedBy: tp.podID}
+		if tp.tagsFunc != nil {
+			tags[keyStr] = tp.tagsFunc(key, value)
+		}
+	}
+	if len(keyStrs) == 0 {
+		return nil
+	}
+
+	err = tp.db.Transaction(func(tx *gorm.DB) error {
+		err := tp.clearForPrime(tx, keyStrs, now)
+		if err != nil {
+			return err
+		}
+		err = tp.store.putCompleted(tx, completedTasks)
+		if err != nil {
+			return err
+		}
+		for _, keyStr := range keyStrs {
+			err = tp.storeTags(tx, keyStr, tags[keyStr])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, value := range stored {
+		tp.failureCache.Remove(key)
+		tp.cacheCompleted(key, value)
+	}
+	return nil
+}
+
+// PrimeError records a failure observed elsewhere, so later loads return it without calling the getter until it expires (see WithFailureTTL)
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) PrimeError(key KEY_TYPE, err error) error {
+	return tp.PrimeErrors(map[KEY_TYPE]error{key: err})
+}
+
+// PrimeErrors is the bulk version of PrimeError; with PrimeFailIfExists, nothing is stored if any key already exists
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) PrimeErrors(errs map[KEY_TYPE]error) error {
+	err := tp.enter()
+	if err != nil {
+		return err
+	}
+	defer tp.leave()
+
+	now := time.Now()
+	expiresAt := now.Add(tp.failureTTL)
+	keyStrs := make([]string, 0, len(errs))
+	failedTasks := make([]FailedTask, 0, len(errs))
+	primed := make(map[KEY_TYPE]FailedTask, len(errs))
+	for key, err := range errs {
+		keyStr, keyErr := tp.getKeyStr(key)
+		if keyErr != nil {
+			return keyErr
+		}
+		failedTask := newFailedTask(keyStr, err, now, expiresAt)
+		keyStrs = append(keyStrs, keyStr)
+		failedTasks = append(failedTasks, failedTask)
+		primed[key] = failedTask
+	}
+	if len(keyStrs) == 0 {
+		return nil
+	}
+
+	err = tp.db.Transaction(func(tx *gorm.DB) error {
+		err := tp.clearForPrime(tx, keyStrs, now)
+		if err != nil {
+			return err
+		}
+		return tp.store.putFailed(tx, failedTasks)
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, failedTask := range primed {
+		tp.completedCache.Remove(key)
+		tp.failureCache.Set(key, failedTask, expiresAt)
+	}
+	return nil
+}
+
+// applies the prime policy, then tells other pods to drop their in-memory copies; storing the primed outcomes clears any pending claims
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) clearForPrime(tx *gorm.DB, keyStrs []string, now time.Time) error {
+	if tp.primePolicy == PrimeFailIfExists {
+		reserved, err := tp.store.reserve(tx, keyStrs, now)
+		if err != nil {
+			return err
+		}
+		if !reserved {
+			return ErrAlreadyExists
+		}
+	}
+	return tp.recordInvalidations(tx, keyStrs, now)
+}
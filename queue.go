@@ -0,0 +1,150 @@
+package deduplicate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const defaultWorkerPollInterval = time.Second
+
+// how long a queued key that couldn't get capacity (see isUnrecordedError) waits before a worker tries it again, so workers don't spin on it
+const queuedTaskRetryDelay = time.Second * 5
+
+// a request for some pod's workers to compute a key
+type QueuedTask struct {
+	Key       string    `gorm:"primaryKey"`
+	Namespace string    `gorm:"index"`
+	CreatedAt time.Time `gorm:"default:NOW();index"`
+	// the json-encoded key, so whichever pod claims the task can rebuild it
+	Payload  string
+	Priority Priority `gorm:"index"`
+	// a worker is computing the key until then; leases that run out (for example because the worker's pod died) are picked up by another worker
+	LeasedUntil *time.Time `gorm:"index"`
+}
+
+// Enqueue asks for a key to be computed by the pool's workers (see WithWorkers) and returns right away
+// enqueueing a key that is already queued only ever raises its priority
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) Enqueue(key KEY_TYPE, opts ...LoadOption) error {
+	err := tp.enter()
+	if err != nil {
+		return err
+	}
+	defer tp.leave()
+
+	call := newLoadOptions(opts)
+	stored, ok := tp.completedCache.Get(key)
+	if ok && stored.isFresh() {
+		return nil
+	}
+	keyStr, err := tp.getKeyStr(key)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return tp.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.Set{{Column: clause.Column{Name: "priority"}, Value: gorm.Expr("GREATEST(queued_tasks.priority, excluded.priority)")}},
+	}).Create(&QueuedTask{
+		Key:       keyStr,
+		Namespace: tp.getterName,
+		CreatedAt: time.Now(),
+		Payload:   string(payload),
+		Priority:  call.priority,
+	}).Error
+}
+
+// starts workers that each compute one queued key at a time
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) startWorkers(count int, pollInterval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	tp.cancellers = append(tp.cancellers, cancel)
+	for i := 0; i < count; i++ {
+		go tp.runWorker(ctx, pollInterval)
+	}
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) runWorker(ctx context.Context, pollInterval time.Duration) {
+	for {
+		worked, err := tp.workQueuedTask(ctx)
+		if err != nil {
+			log.Printf("error working queued task: %v", err)
+		}
+		if worked {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// claims the most urgent queued key that no other worker is looking at, and computes it unless another pod already is
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) workQueuedTask(ctx context.Context) (bool, error) {
+	err := tp.enter()
+	if err != nil {
+		return false, nil
+	}
+	defer tp.leave()
+
+	queuedTask, found, err := tp.claimQueuedTask()
+	if err != nil || !found {
+		return false, err
+	}
+	var key KEY_TYPE
+	err = json.Unmarshal([]byte(queuedTask.Payload), &key)
+	if err != nil {
+		return true, err
+	}
+	_, err = tp.load(ctx, key, loadWork, loadOptions{priority: queuedTask.Priority})
+	switch {
+	case errors.Is(err, ErrPending):
+		// another pod is computing the key; the lease runs out once that claim would have, and the next worker finds its result (or takes over)
+		return true, nil
+	case isUnrecordedError(err):
+		// nothing was stored for the key, so it goes back in the queue
+		log.Printf("error computing queued task %s, retrying in %v: %v", queuedTask.Key, queuedTaskRetryDelay, err)
+		return true, tp.leaseQueuedTask(queuedTask.Key, time.Now().Add(queuedTaskRetryDelay))
+	case err != nil:
+		log.Printf("error computing queued task %s: %v", queuedTask.Key, err)
+	}
+	return true, tp.db.Where("key = ?", queuedTask.Key).Delete(&QueuedTask{}).Error
+}
+
+// leases the most urgent queued key for pendingTTL; the row stays until the key is done, so a worker dying part way through only delays it
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) claimQueuedTask() (QueuedTask, bool, error) {
+	claimed := []QueuedTask{}
+	err := tp.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("namespace = ?", tp.getterName).
+			Where("leased_until IS NULL OR leased_until < ?", now).
+			Order(tp.effectivePrioritySQL("") + " DESC, created_at").
+			Limit(1).
+			Find(&claimed)
+		if result.Error != nil || len(claimed) == 0 {
+			return result.Error
+		}
+		return tx.Model(&QueuedTask{}).Where("key = ?", claimed[0].Key).Update("leased_until", now.Add(tp.pendingTTL)).Error
+	})
+	if err != nil || len(claimed) == 0 {
+		return QueuedTask{}, false, err
+	}
+	return claimed[0], true, nil
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) leaseQueuedTask(keyStr string, until time.Time) error {
+	return tp.db.Model(&QueuedTask{}).Where("key = ?", keyStr).Update("leased_until", until).Error
+}
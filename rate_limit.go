@@ -0,0 +1,173 @@
+package deduplicate
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrRateLimited is matched (with errors.Is) by every RateLimitedError; rate limited calls are never cached as failures
+var ErrRateLimited = errors.New("getter rate limit reached")
+
+type RateLimitedError struct {
+	// how long until a token is expected to be available
+	RetryAfter time.Duration
+}
+
+func (rle RateLimitedError) Error() string {
+	return "getter rate limit reached, retry after " + rle.RetryAfter.String()
+}
+
+func (rle RateLimitedError) Unwrap() error {
+	return ErrRateLimited
+}
+
+// limits how often the getter is called across every pod sharing the database
+type RateLimit struct {
+	// tokens added to the bucket per second; zero means only the daily quota applies
+	PerSecond float64
+	// the most tokens the bucket holds, i.e. the largest burst of calls allowed at once (defaults to PerSecond rounded up)
+	Burst int
+	// the most calls allowed per UTC day; zero means no daily quota
+	DailyQuota int
+	// whether callers wait for a token rather than failing right away with a RateLimitedError; calls still fail right away when the next token is more than pendingTTL off
+	Wait bool
+}
+
+// a token bucket shared by every pod; rows are locked while a token is taken
+type RateLimitBucket struct {
+	Namespace  string `gorm:"primaryKey"`
+	Tokens     float64
+	RefilledAt time.Time
+	// the UTC day DayCount applies to, formatted as 2006-01-02
+	Day      string
+	DayCount int
+}
+
+func (rl RateLimit) burst() float64 {
+	if rl.Burst > 0 {
+		return float64(rl.Burst)
+	}
+	return math.Max(1, math.Ceil(rl.PerSecond))
+}
+
+// refills the bucket up to now and rolls the daily count over, without taking anything
+func (rl RateLimit) refill(bucket RateLimitBucket, now time.Time) RateLimitBucket {
+	if rl.PerSecond > 0 {
+		elapsed := now.Sub(bucket.RefilledAt).Seconds()
+		if elapsed > 0 {
+			bucket.Tokens = math.Min(rl.burst(), bucket.Tokens+elapsed*rl.PerSecond)
+		}
+	}
+	bucket.RefilledAt = now
+	today := now.UTC().Format("2006-01-02")
+	if bucket.Day != today {
+		bucket.Day = today
+		bucket.DayCount = 0
+	}
+	return bucket
+}
+
+// takes a token if one is available, otherwise reports how long until one should be
+func (rl RateLimit) take(bucket RateLimitBucket, now time.Time) (RateLimitBucket, time.Duration) {
+	bucket = rl.refill(bucket, now)
+	if rl.DailyQuota > 0 && bucket.DayCount >= rl.DailyQuota {
+		tomorrow := now.UTC().Truncate(time.Hour * 24).Add(time.Hour * 24)
+		return bucket, tomorrow.Sub(now)
+	}
+	if rl.PerSecond > 0 {
+		if bucket.Tokens < 1 {
+			return bucket, time.Duration((1 - bucket.Tokens) / rl.PerSecond * float64(time.Second))
+		}
+		bucket.Tokens--
+	}
+	bucket.DayCount++
+	return bucket, 0
+}
+
+// waits for (or fails without) a token from the cluster-wide rate limiter
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) takeRateLimitToken(ctx context.Context, call loadOptions) error {
+	if tp.rateLimit == nil {
+		return nil
+	}
+	wait := tp.rateLimit.Wait
+	if call.rateLimitWait != nil {
+		wait = *call.rateLimitWait
+	}
+	for {
+		retryAfter, err := tp.tryTakeRateLimitToken()
+		if err != nil || retryAfter == 0 {
+			return err
+		}
+		// a token further off than pendingTTL (an exhausted daily quota, say) isn't worth holding the key's claim for
+		if !wait || retryAfter > tp.pendingTTL {
+			return RateLimitedError{RetryAfter: retryAfter}
+		}
+		select {
+		case <-time.After(retryAfter):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) tryTakeRateLimitToken() (time.Duration, error) {
+	var retryAfter time.Duration
+	err := tp.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&RateLimitBucket{
+			Namespace:  tp.getterName,
+			Tokens:     tp.rateLimit.burst(),
+			RefilledAt: now,
+			Day:        now.UTC().Format("2006-01-02"),
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		bucket := RateLimitBucket{}
+		result = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("namespace = ?", tp.getterName).Take(&bucket)
+		if result.Error != nil {
+			return result.Error
+		}
+		bucket, retryAfter = tp.rateLimit.take(bucket, now)
+		return tx.Save(&bucket).Error
+	})
+	return retryAfter, err
+}
+
+// the rate limiter's remaining budget
+type RateLimitStats struct {
+	// tokens currently in the bucket; calls can be made right away while this is at least 1
+	Tokens float64
+	// calls left today, or -1 when there is no daily quota
+	DailyRemaining int
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) rateLimitStats() (*RateLimitStats, error) {
+	if tp.rateLimit == nil {
+		return nil, nil
+	}
+	now := time.Now()
+	buckets := []RateLimitBucket{}
+	result := tp.db.Where("namespace = ?", tp.getterName).Find(&buckets)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	bucket := RateLimitBucket{Tokens: tp.rateLimit.burst(), RefilledAt: now}
+	if len(buckets) > 0 {
+		bucket = buckets[0]
+	}
+	bucket = tp.rateLimit.refill(bucket, now)
+	stats := RateLimitStats{Tokens: bucket.Tokens, DailyRemaining: -1}
+	if tp.rateLimit.PerSecond <= 0 {
+		stats.Tokens = math.Inf(1)
+	}
+	if tp.rateLimit.DailyQuota > 0 {
+		stats.DailyRemaining = tp.rateLimit.DailyQuota - bucket.DayCount
+	}
+	return &stats, nil
+}
@@ -0,0 +1,70 @@
+package deduplicate
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nuvi/unicycle/channels"
+)
+
+type refreshAhead[KEY_TYPE comparable] struct {
+	window        time.Duration
+	minReads      int
+	maxConcurrent int
+
+	reads map[KEY_TYPE]int
+	lock  *sync.Mutex
+}
+
+func newRefreshAhead[KEY_TYPE comparable](window time.Duration, minReads, maxConcurrent int) *refreshAhead[KEY_TYPE] {
+	return &refreshAhead[KEY_TYPE]{
+		window:        window,
+		minReads:      minReads,
+		maxConcurrent: maxConcurrent,
+		reads:         map[KEY_TYPE]int{},
+		lock:          &sync.Mutex{},
+	}
+}
+
+func (ra *refreshAhead[KEY_TYPE]) record(key KEY_TYPE) {
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	ra.reads[key]++
+}
+
+// returns the keys read at least minReads times since the last call, and starts a new window
+func (ra *refreshAhead[KEY_TYPE]) drainHot() []KEY_TYPE {
+	ra.lock.Lock()
+	reads := ra.reads
+	ra.reads = map[KEY_TYPE]int{}
+	ra.lock.Unlock()
+
+	hot := []KEY_TYPE{}
+	for key, count := range reads {
+		if count >= ra.minReads {
+			hot = append(hot, key)
+		}
+	}
+	return hot
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) recordRead(key KEY_TYPE) {
+	if tp.refreshAhead != nil {
+		tp.refreshAhead.record(key)
+	}
+}
+
+// runs once per window, re-running the getter for hot keys that would otherwise expire before the next run
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) refreshHotKeys() {
+	refreshBefore := time.Now().Add(tp.refreshAhead.window)
+	expiring := []KEY_TYPE{}
+	for _, key := range tp.refreshAhead.drainHot() {
+		stored, ok := tp.completedCache.Get(key)
+		if ok && stored.expiresAt.Before(refreshBefore) {
+			expiring = append(expiring, key)
+		}
+	}
+	channels.ForEachMultithread(expiring, func(key KEY_TYPE) {
+		tp.revalidate(key, "", refreshBefore)
+	}, tp.refreshAhead.maxConcurrent)
+}
@@ -0,0 +1,65 @@
+package deduplicate
+
+import (
+	"context"
+	"time"
+)
+
+// where a loaded value came from
+type Source int
+
+const (
+	// this pod's in-memory cache
+	SourceMemory Source = iota
+	// a row some pod stored earlier
+	SourceDatabase
+	// another pod was already computing the value, and this pod waited for it
+	SourceAwaited
+	// this call ran the getter itself
+	SourceGetter
+)
+
+func (source Source) String() string {
+	switch source {
+	case SourceMemory:
+		return "memory"
+	case SourceDatabase:
+		return "database"
+	case SourceAwaited:
+		return "awaited"
+	case SourceGetter:
+		return "getter"
+	default:
+		return "unknown"
+	}
+}
+
+// a loaded value along with where it came from and how it was computed
+type Result[VALUE_TYPE any] struct {
+	Value  VALUE_TYPE
+	Source Source
+	// true when the value is past its expiry and was served by stale-while-revalidate or stale-if-error
+	Stale bool
+
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	// the pod ID (see WithPodID) that ran the getter
+	ComputedBy     string
+	GetterDuration time.Duration
+
+	// the error Load would have returned; a non-nil error may still come with a value (see StaleError)
+	Err error
+}
+
+// LoadWithMeta is like Load, but also reports where the value came from, how old it is and how it was computed
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) LoadWithMeta(key KEY_TYPE, opts ...LoadOption) (Result[VALUE_TYPE], error) {
+	err := tp.enter()
+	if err != nil {
+		return Result[VALUE_TYPE]{Err: err}, err
+	}
+	defer tp.leave()
+
+	result, err := tp.load(context.Background(), key, loadAwait, newLoadOptions(opts))
+	result.Err = err
+	return result, err
+}
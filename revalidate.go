@@ -0,0 +1,86 @@
+package deduplicate
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// recomputes a value that is still being served, without disturbing readers, unless the stored value no longer expires before refreshBefore
+// the pending claim makes sure only one pod refreshes a given key at a time; a failed refresh is stored like any other failure, so a struggling upstream isn't retried on every read before the failure expires
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) revalidate(key KEY_TYPE, keyStr string, refreshBefore time.Time) {
+	if keyStr == "" {
+		var err error
+		keyStr, err = tp.getKeyStr(key)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	// avoid asking the database for a claim on every read while this pod is already refreshing
+	tp.revalidatingLock.Lock()
+	if tp.revalidating.Has(keyStr) {
+		tp.revalidatingLock.Unlock()
+		return
+	}
+	tp.revalidating.Add(keyStr)
+	tp.revalidatingLock.Unlock()
+	defer func() {
+		tp.revalidatingLock.Lock()
+		tp.revalidating.Remove(keyStr)
+		tp.revalidatingLock.Unlock()
+	}()
+
+	err := tp.enter()
+	if err != nil {
+		return
+	}
+	defer tp.leave()
+
+	if _, failed := tp.failureCache.Get(key); failed {
+		return
+	}
+	claimID, err := tp.createPendingTask(keyStr, PriorityNormal)
+	if err != nil {
+		if !errors.Is(err, errPendingStarted) {
+			log.Println(err)
+		}
+		return
+	}
+
+	// another pod may have refreshed the value (or failed to) since it was last read here
+	state, err := tp.lookupTask(keyStr, false)
+	if err == nil && state.completed != nil && !state.completed.expiresAt.Before(refreshBefore) {
+		tp.cacheCompleted(key, *state.completed)
+		tp.deletePendingTask(keyStr, claimID)
+		return
+	} else if err == nil && state.failed != nil {
+		tp.failureCache.Set(key, *state.failed, state.failed.expiresAt(tp.valueTTL))
+		tp.deletePendingTask(keyStr, claimID)
+		return
+	}
+
+	stored, err := tp.runGetter(context.Background(), key, keyStr, claimID, loadOptions{priority: PriorityNormal})
+	if errors.Is(err, ErrCancelled) {
+		return
+	} else if isUnrecordedError(err) {
+		tp.deletePendingTask(keyStr, claimID)
+		return
+	} else if err != nil {
+		// storing the failure also ends the claim, so readers aren't left waiting on it once the stale value runs out
+		log.Printf("error refreshing %s: %v", keyStr, err)
+		completedAt := time.Now()
+		expiresAt := completedAt.Add(tp.failureTTL)
+		tp.failureCache.Set(key, err, expiresAt)
+		_ = tp.writes.attempt(key, func() error {
+			return tp.dropIfClaimLost(key, tp.createFailedTask(keyStr, claimID, err, completedAt, expiresAt))
+		}, func() { tp.deletePendingTask(keyStr, claimID) })
+		return
+	}
+	tp.cacheCompleted(key, stored)
+	_ = tp.writes.attempt(key, func() error {
+		return tp.dropIfClaimLost(key, tp.createCompletedTask(key, keyStr, claimID, stored))
+	}, func() { tp.deletePendingTask(keyStr, claimID) })
+}
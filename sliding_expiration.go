@@ -0,0 +1,81 @@
+package deduplicate
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nuvi/unicycle/sets"
+)
+
+// the largest number of keys extended by a single UPDATE
+const slidingFlushBatchSize = 1000
+
+type slidingExpiration struct {
+	ttl           time.Duration
+	flushInterval time.Duration
+
+	touched sets.Set[string]
+	lock    *sync.Mutex
+}
+
+func newSlidingExpiration(ttl, flushInterval time.Duration) *slidingExpiration {
+	return &slidingExpiration{
+		ttl:           ttl,
+		flushInterval: flushInterval,
+		touched:       sets.Set[string]{},
+		lock:          &sync.Mutex{},
+	}
+}
+
+func (se *slidingExpiration) add(keyStr string) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	se.touched.Add(keyStr)
+}
+
+func (se *slidingExpiration) drain() []string {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+	keyStrs := se.touched.Values()
+	se.touched = sets.Set[string]{}
+	return keyStrs
+}
+
+// pushes back the expiry of a completed value that was just read
+// reads are throttled so that a key is only written back once its expiry would move by at least one flush interval, and writes are batched by flushTouches
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) touch(key KEY_TYPE, keyStr string, stored storedValue[VALUE_TYPE]) {
+	if tp.sliding == nil {
+		return
+	}
+	extended := time.Now().Add(tp.sliding.ttl)
+	if extended.Sub(stored.expiresAt) < tp.sliding.flushInterval {
+		return
+	}
+	if keyStr == "" {
+		var err error
+		keyStr, err = tp.getKeyStr(key)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	stored.expiresAt = extended
+	tp.cacheCompleted(key, stored)
+	tp.sliding.add(keyStr)
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) flushTouches() {
+	keyStrs := tp.sliding.drain()
+	now := time.Now()
+	for start := 0; start < len(keyStrs); start += slidingFlushBatchSize {
+		end := start + slidingFlushBatchSize
+		if end > len(keyStrs) {
+			end = len(keyStrs)
+		}
+		err := tp.store.extendExpiry(keyStrs[start:end], now, now.Add(tp.sliding.ttl))
+		if err != nil {
+			log.Printf("error extending sliding expiration: %v", err)
+		}
+	}
+}
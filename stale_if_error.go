@@ -0,0 +1,43 @@
+package deduplicate
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrStale marks a value that was served after its getter failed; check for it with errors.Is
+var ErrStale = errors.New("serving stale value")
+
+// returned alongside the last good value when stale-if-error is enabled and a fresh value couldn't be computed
+type StaleError struct {
+	Cause error
+}
+
+func (se StaleError) Error() string {
+	return "serving stale value after error: " + se.Cause.Error()
+}
+
+func (se StaleError) Unwrap() []error {
+	return []error{ErrStale, se.Cause}
+}
+
+// how long completed rows are kept past their expiry, so they can be served stale by either mode
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) staleRetention() time.Duration {
+	if tp.staleIfErrorTTL > tp.staleTTL {
+		return tp.staleIfErrorTTL
+	}
+	return tp.staleTTL
+}
+
+// whether a stored value can be returned without consulting failures or the getter
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) isServable(stored storedValue[VALUE_TYPE]) bool {
+	return stored.isFresh() || time.Now().Before(stored.expiresAt.Add(tp.staleTTL))
+}
+
+// falls back to the last good value when stale-if-error allows it
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) failWithFallback(fallback *storedValue[VALUE_TYPE], source Source, err error) (Result[VALUE_TYPE], error) {
+	if fallback != nil && time.Now().Before(fallback.expiresAt.Add(tp.staleIfErrorTTL)) {
+		return fallback.result(source), StaleError{Cause: err}
+	}
+	return Result[VALUE_TYPE]{Source: source}, err
+}
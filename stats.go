@@ -0,0 +1,39 @@
+package deduplicate
+
+// a snapshot of the pool's limits, for dashboards and for deciding whether to start more work
+type Stats struct {
+	// getters running in this process, and callers waiting for a turn (only counted with WithMaxInFlight)
+	InFlight int
+	Queued   int
+	// nil when the pool has no rate limit
+	RateLimit *RateLimitStats
+	// nil when the pool has no circuit breaker
+	CircuitBreaker *CircuitBreakerStats
+	Writes         WriteStats
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) Stats() (Stats, error) {
+	err := tp.enter()
+	if err != nil {
+		return Stats{}, err
+	}
+	defer tp.leave()
+
+	rateLimit, err := tp.rateLimitStats()
+	if err != nil {
+		return Stats{}, err
+	}
+	circuitBreaker, err := tp.circuitBreakerStats()
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := Stats{
+		RateLimit:      rateLimit,
+		CircuitBreaker: circuitBreaker,
+		Writes:         tp.writeStats(),
+	}
+	if tp.inFlightLimit != nil {
+		stats.InFlight, stats.Queued = tp.inFlightLimit.counts()
+	}
+	return stats, nil
+}
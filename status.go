@@ -0,0 +1,107 @@
+package deduplicate
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrPending is returned by TryLoad when the value is still being computed
+var ErrPending = errors.New("task is pending")
+
+type State int
+
+const (
+	StateAbsent State = iota
+	StatePending
+	StateCompleted
+	StateFailed
+	// the task was cancelled with Cancel and hasn't been started again since
+	StateCancelled
+)
+
+func (state State) String() string {
+	switch state {
+	case StateAbsent:
+		return "absent"
+	case StatePending:
+		return "pending"
+	case StateCompleted:
+		return "completed"
+	case StateFailed:
+		return "failed"
+	case StateCancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// a snapshot of where a key's task stands
+type Status struct {
+	State State
+
+	// set for StatePending and StateCancelled: when the task was claimed (or its claim last renewed), the pod ID of the pod running it, and the highest priority it was asked for with
+	PendingSince time.Time
+	Owner        string
+	Priority     Priority
+
+	// set for StateCompleted and StateFailed
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	// set for StateFailed
+	Err error
+}
+
+// Peek reports the state of a key's task without starting it or waiting on it
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) Peek(key KEY_TYPE) (Status, error) {
+	err := tp.enter()
+	if err != nil {
+		return Status{}, err
+	}
+	defer tp.leave()
+
+	stored, ok := tp.completedCache.Get(key)
+	if ok && tp.isServable(stored) {
+		return Status{State: StateCompleted, CreatedAt: stored.createdAt, ExpiresAt: stored.expiresAt}, nil
+	}
+
+	keyStr, err := tp.getKeyStr(key)
+	if err != nil {
+		return Status{}, err
+	}
+
+	state, err := tp.lookupTask(keyStr, true)
+	if err != nil {
+		return Status{}, err
+	}
+
+	if state.completed != nil && tp.isServable(*state.completed) {
+		return Status{State: StateCompleted, CreatedAt: state.completed.createdAt, ExpiresAt: state.completed.expiresAt}, nil
+	}
+
+	if state.failed != nil {
+		return Status{State: StateFailed, CreatedAt: state.failed.CreatedAt, ExpiresAt: state.failed.expiresAt(tp.valueTTL), Err: *state.failed}, nil
+	}
+
+	if pendingTask := state.pending; pendingTask != nil && pendingTask.Cancelled {
+		return Status{State: StateCancelled, PendingSince: pendingTask.CreatedAt, Owner: pendingTask.Owner, Priority: pendingTask.Priority}, nil
+	} else if pendingTask != nil && !pendingTask.isExpired(tp.pendingTTL) {
+		return Status{State: StatePending, PendingSince: pendingTask.CreatedAt, Owner: pendingTask.Owner, Priority: pendingTask.Priority}, nil
+	}
+
+	return Status{State: StateAbsent}, nil
+}
+
+// TryLoad returns the value if one is available; otherwise it makes sure the task is running (starting it in the background if needed) and returns ErrPending right away
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) TryLoad(key KEY_TYPE, opts ...LoadOption) (VALUE_TYPE, error) {
+	err := tp.enter()
+	if err != nil {
+		var zero VALUE_TYPE
+		return zero, err
+	}
+	defer tp.leave()
+
+	result, err := tp.load(context.Background(), key, loadTry, newLoadOptions(opts))
+	return result.Value, err
+}
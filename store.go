@@ -0,0 +1,98 @@
+package deduplicate
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nuvi/go-dataloader"
+	"gorm.io/gorm"
+)
+
+// where pending claims, results and failures are kept; writes that take a tx are part of a caller's transaction
+// the legacy store keeps them in three tables, and the unified store (see WithUnifiedSchema) in one row per key
+type taskStore interface {
+	// a key's rows in one go; expired failures are left out, and rows that don't exist are nil
+	lookup(keyStr string, withPending bool, now time.Time) (taskRows, error)
+	getPending(keyStr string) (PendingTask, error)
+
+	// takes the claim on a key if nobody holds a live one; reports false if somebody does
+	claim(keyStr string, owner string, claimID string, priority Priority, now time.Time) (bool, error)
+	// raises a live claim's priority to priority, unless it is already at least that high
+	raisePriority(keyStr string, priority Priority) error
+	// keeps a claim from expiring, unless it has been cancelled or taken over
+	renew(keyStr string, claimID string, now time.Time) error
+	// gives up a claim without storing an outcome
+	release(keyStr string, claimID string) error
+	// gives up every claim owner holds that hasn't been cancelled
+	releaseOwned(owner string) error
+	cancel(tx *gorm.DB, keyStr string) error
+
+	// stores an outcome and ends the claim it was computed under; if that claim is gone (primed over, invalidated or taken over), nothing is stored and errClaimLost is returned
+	complete(tx *gorm.DB, completedTask CompletedTask, claimID string) error
+	fail(tx *gorm.DB, failedTask FailedTask, claimID string) error
+	// store outcomes computed elsewhere, replacing whatever the keys held, claims included
+	putCompleted(tx *gorm.DB, completedTasks []CompletedTask) error
+	putFailed(tx *gorm.DB, failedTasks []FailedTask) error
+	// takes an ownerless claim on every key for the rest of tx, unless one of them has a live claim or an unexpired value; reports false if any does
+	// claims and primes of the same keys wait on tx, so nothing can slip in between the check and the caller's put
+	reserve(tx *gorm.DB, keyStrs []string, now time.Time) (bool, error)
+
+	deleteKeys(tx *gorm.DB, keyStrs []string) error
+	deleteAll(tx *gorm.DB) error
+	// pushes unexpired values' expiry back to until
+	extendExpiry(keyStrs []string, now time.Time, until time.Time) error
+	// drops abandoned claims, failures past their expiry and values past their expiry plus staleRetention
+	reap(now time.Time, staleRetention time.Duration) error
+	// a condition that holds when the key in keyColumn has a stored value
+	hasValueSQL(keyColumn string) string
+
+	close()
+}
+
+// a key's rows in the store
+type taskRows struct {
+	pending   *PendingTask
+	completed *CompletedTask
+	failed    *FailedTask
+}
+
+// a key's state, with values decoded and anything past its retention left out
+type taskState[VALUE_TYPE any] struct {
+	pending   *PendingTask
+	completed *storedValue[VALUE_TYPE]
+	failed    *FailedTask
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) lookupTask(keyStr string, withPending bool) (taskState[VALUE_TYPE], error) {
+	rows, err := tp.store.lookup(keyStr, withPending, time.Now())
+	if err != nil {
+		return taskState[VALUE_TYPE]{}, err
+	}
+	state := taskState[VALUE_TYPE]{
+		pending: rows.pending,
+		failed:  rows.failed,
+	}
+	if rows.completed != nil {
+		stored, err := tp.decodeCompletedTask(*rows.completed)
+		if err == nil {
+			state.completed = &stored
+		} else if !errors.Is(err, dataloader.ErrMissingResponse) {
+			return taskState[VALUE_TYPE]{}, err
+		}
+	}
+	return state, nil
+}
+
+// whether a failure is still in force
+func isLiveFailure(failedTask FailedTask, valueTTL time.Duration, now time.Time) bool {
+	return now.Before(failedTask.expiresAt(valueTTL))
+}
+
+func missingAsNil[ROW_TYPE any](row ROW_TYPE, err error) (*ROW_TYPE, error) {
+	if errors.Is(err, dataloader.ErrMissingResponse) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
@@ -0,0 +1,49 @@
+package deduplicate
+
+import (
+	"github.com/nuvi/unicycle/sets"
+	"gorm.io/gorm"
+)
+
+// links a completed task to the tags its TagsFunc attached to it
+type TaskTag struct {
+	Key string `gorm:"primaryKey"`
+	Tag string `gorm:"primaryKey;index"`
+}
+
+// replaces the tags attached to a completed task
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) storeTags(tx *gorm.DB, keyStr string, tags []string) error {
+	result := tx.Where("key = ?", keyStr).Delete(&TaskTag{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	taskTags := []TaskTag{}
+	for _, tag := range sets.SetFromSlice(tags).Values() {
+		taskTags = append(taskTags, TaskTag{Key: keyStr, Tag: tag})
+	}
+	return tx.Create(&taskTags).Error
+}
+
+// InvalidateTag drops every result for this pool's getter that was tagged with tag, and makes every pod evict them from memory
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) InvalidateTag(tag string) error {
+	err := tp.enter()
+	if err != nil {
+		return err
+	}
+	defer tp.leave()
+
+	keyStrs := []string{}
+	result := tp.db.Model(&TaskTag{}).Where("tag = ? AND key LIKE ?", tag, tp.getterName+"-%").Pluck("key", &keyStrs)
+	if result.Error != nil {
+		return result.Error
+	}
+	err = tp.invalidateKeyStrs(keyStrs)
+	if err != nil {
+		return err
+	}
+	tp.evictKeyStrs(keyStrs)
+	return nil
+}
@@ -1,32 +1,65 @@
 package deduplicate
 
 import (
+	"context"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/nuvi/go-cache"
-	"github.com/nuvi/go-dataloader"
-	gormLoader "github.com/nuvi/go-dataloader/gorm"
 	"github.com/nuvi/unicycle/multithread"
+	"github.com/nuvi/unicycle/sets"
 	"gorm.io/gorm"
 )
 
 type TaskPool[KEY_TYPE comparable, VALUE_TYPE any] struct {
 	db     *gorm.DB
-	getter func(KEY_TYPE) (VALUE_TYPE, error)
+	getter func(context.Context, KEY_TYPE) (VALUE_TYPE, time.Duration, error)
 
 	pendingTTL time.Duration
 	valueTTL   time.Duration
+	ttlFunc    func(KEY_TYPE, VALUE_TYPE) time.Duration
+	tagsFunc   func(KEY_TYPE, VALUE_TYPE) []string
+	sliding    *slidingExpiration
+	staleTTL   time.Duration
 
-	completedCache *cache.TTLCache[KEY_TYPE, VALUE_TYPE]
-	failureCache   *cache.TTLCache[KEY_TYPE, error]
+	failureTTL      time.Duration
+	staleIfErrorTTL time.Duration
 
-	pendingTaskBatcher   *dataloader.QueryBatcher[string, PendingTask]
-	completedTaskBatcher *dataloader.QueryBatcher[string, CompletedTask]
-	failedTaskBatcher    *dataloader.QueryBatcher[string, FailedTask]
+	refreshAhead *refreshAhead[KEY_TYPE]
+
+	watches watches[VALUE_TYPE]
+
+	lastInvalidationID uint64
+	seenInvalidations  sets.Set[uint64]
+	primePolicy        PrimePolicy
+	priorityAging      time.Duration
+
+	concurrencyLimit *concurrencyLimit
+	rateLimit        *RateLimit
+	inFlightLimit    *inFlightLimit
+	getterTimeout    time.Duration
+	circuitBreaker   *CircuitBreaker
+
+	writes *writeBehind[KEY_TYPE]
+
+	completedCache *expiringCache[KEY_TYPE, storedValue[VALUE_TYPE]]
+	failureCache   *expiringCache[KEY_TYPE, error]
+
+	store taskStore
+
+	revalidating     sets.Set[string]
+	revalidatingLock *sync.Mutex
 
 	getterName string
-	canceller  func()
+	podID      string
+	cancellers []func()
+
+	// guards closed, so that nothing new is tracked by inFlight once Close starts waiting on it
+	closeLock *sync.RWMutex
+	closed    bool
+	closing   chan struct{}
+	inFlight  *sync.WaitGroup
 }
 
 func NewTaskPool[KEY_TYPE comparable, VALUE_TYPE any](
@@ -36,12 +69,102 @@ func NewTaskPool[KEY_TYPE comparable, VALUE_TYPE any](
 	valueTTL time.Duration,
 	maxConcurrentBatches int,
 	maxBatchSize int,
+	opts ...Option,
 ) (*TaskPool[KEY_TYPE, VALUE_TYPE], error) {
-	err := db.AutoMigrate(
-		&PendingTask{},
-		&CompletedTask{},
-		&FailedTask{},
+	return newTaskPool(
+		db,
+		func(_ context.Context, key KEY_TYPE) (VALUE_TYPE, time.Duration, error) {
+			value, err := getter(key)
+			return value, 0, err
+		},
+		getFunctionName(getter),
+		pendingTTL,
+		valueTTL,
+		maxConcurrentBatches,
+		maxBatchSize,
+		opts,
 	)
+}
+
+// like NewTaskPool, except the getter also returns how long its result should live
+// a non-positive duration falls back to the TTLFunc option if one was given, and then to valueTTL
+func NewTaskPoolWithTTL[KEY_TYPE comparable, VALUE_TYPE any](
+	db *gorm.DB,
+	getter func(KEY_TYPE) (VALUE_TYPE, time.Duration, error),
+	pendingTTL time.Duration,
+	valueTTL time.Duration,
+	maxConcurrentBatches int,
+	maxBatchSize int,
+	opts ...Option,
+) (*TaskPool[KEY_TYPE, VALUE_TYPE], error) {
+	return newTaskPool(
+		db,
+		func(_ context.Context, key KEY_TYPE) (VALUE_TYPE, time.Duration, error) {
+			return getter(key)
+		},
+		getFunctionName(getter),
+		pendingTTL,
+		valueTTL,
+		maxConcurrentBatches,
+		maxBatchSize,
+		opts,
+	)
+}
+
+// like NewTaskPoolWithTTL, except the getter is given a context that is cancelled when its timeout passes or the caller gives up
+func NewTaskPoolWithContext[KEY_TYPE comparable, VALUE_TYPE any](
+	db *gorm.DB,
+	getter func(context.Context, KEY_TYPE) (VALUE_TYPE, time.Duration, error),
+	pendingTTL time.Duration,
+	valueTTL time.Duration,
+	maxConcurrentBatches int,
+	maxBatchSize int,
+	opts ...Option,
+) (*TaskPool[KEY_TYPE, VALUE_TYPE], error) {
+	return newTaskPool(
+		db,
+		getter,
+		getFunctionName(getter),
+		pendingTTL,
+		valueTTL,
+		maxConcurrentBatches,
+		maxBatchSize,
+		opts,
+	)
+}
+
+func newTaskPool[KEY_TYPE comparable, VALUE_TYPE any](
+	db *gorm.DB,
+	getter func(context.Context, KEY_TYPE) (VALUE_TYPE, time.Duration, error),
+	getterName string,
+	pendingTTL time.Duration,
+	valueTTL time.Duration,
+	maxConcurrentBatches int,
+	maxBatchSize int,
+	opts []Option,
+) (*TaskPool[KEY_TYPE, VALUE_TYPE], error) {
+	config := options{}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	ttlFunc, err := typedHook[func(KEY_TYPE, VALUE_TYPE) time.Duration]("TTLFunc", config.ttlFunc)
+	if err != nil {
+		return nil, err
+	}
+	tagsFunc, err := typedHook[func(KEY_TYPE, VALUE_TYPE) []string]("TagsFunc", config.tagsFunc)
+	if err != nil {
+		return nil, err
+	}
+	persistFailureHook, err := typedHook[func(PersistFailure[KEY_TYPE])]("PersistFailureHook", config.persistFailureHook)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.skipAutoMigrate {
+		err = checkSchema(db, poolModels(config.unifiedSchema))
+	} else {
+		err = db.AutoMigrate(poolModels(config.unifiedSchema)...)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -52,52 +175,171 @@ func NewTaskPool[KEY_TYPE comparable, VALUE_TYPE any](
 
 		pendingTTL: pendingTTL,
 		valueTTL:   valueTTL,
+		ttlFunc:    ttlFunc,
+		tagsFunc:   tagsFunc,
+		staleTTL:   config.staleTTL,
+
+		failureTTL:      valueTTL,
+		staleIfErrorTTL: config.staleIfErrorTTL,
 
-		completedCache: cache.NewTTLCache[KEY_TYPE, VALUE_TYPE](valueTTL, valueTTL/4),
-		failureCache:   cache.NewTTLCache[KEY_TYPE, error](valueTTL, valueTTL/4),
+		primePolicy:   config.primePolicy,
+		priorityAging: config.priorityAging,
 
-		getterName: getFunctionName(getter),
+		getterTimeout:  config.getterTimeout,
+		circuitBreaker: config.circuitBreaker,
+
+		watches: newWatches[VALUE_TYPE](),
+
+		seenInvalidations: sets.Set[uint64]{},
+
+		completedCache: newExpiringCache[KEY_TYPE, storedValue[VALUE_TYPE]](valueTTL / 4),
+		failureCache:   newExpiringCache[KEY_TYPE, error](valueTTL / 4),
+
+		revalidating:     sets.Set[string]{},
+		revalidatingLock: &sync.Mutex{},
+
+		getterName: getterName,
+		podID:      config.podID,
+
+		closeLock: &sync.RWMutex{},
+		closing:   make(chan struct{}),
+		inFlight:  &sync.WaitGroup{},
+	}
+	if toReturn.podID == "" {
+		toReturn.podID = defaultPodID()
 	}
 
-	toReturn.pendingTaskBatcher = dataloader.NewQueryBatcher(
-		gormLoader.GormGetter(db, "key", func(task PendingTask) string { return task.Key }),
-		maxConcurrentBatches,
-		maxBatchSize,
-	)
-	toReturn.completedTaskBatcher = dataloader.NewQueryBatcher(
-		gormLoader.GormGetter(db, "key", func(task CompletedTask) string { return task.Key }),
-		maxConcurrentBatches,
-		maxBatchSize,
-	)
-	toReturn.failedTaskBatcher = dataloader.NewQueryBatcher(
-		gormLoader.GormGetter(db, "key", func(task FailedTask) string { return task.Key }),
-		maxConcurrentBatches,
-		maxBatchSize,
-	)
+	if toReturn.priorityAging <= 0 {
+		toReturn.priorityAging = defaultPriorityAging
+	}
+	if config.concurrencyLimit > 0 {
+		toReturn.concurrencyLimit = &concurrencyLimit{
+			limit:   config.concurrencyLimit,
+			maxWait: config.concurrencyMaxWait,
+			lease:   pendingTTL,
+			tokens:  &atomic.Uint64{},
+		}
+	}
+	if config.rateLimit != nil && (config.rateLimit.PerSecond > 0 || config.rateLimit.DailyQuota > 0) {
+		toReturn.rateLimit = config.rateLimit
+	}
+	if config.maxInFlight > 0 {
+		toReturn.inFlightLimit = newInFlightLimit(config.maxInFlight, config.maxQueued, toReturn.priorityAging)
+	}
+	if config.writeQueueSize <= 0 {
+		config.writeQueueSize = defaultWriteQueueSize
+	}
+	if config.writeWorkers <= 0 {
+		config.writeWorkers = defaultWriteWorkers
+	}
+	if config.writeMaxAttempts <= 0 {
+		config.writeMaxAttempts = defaultWriteMaxAttempts
+	}
+	if config.writeBackoff <= 0 {
+		config.writeBackoff = defaultWriteBackoff
+	}
+	toReturn.writes = &writeBehind[KEY_TYPE]{
+		queue:        make(chan pendingWrite[KEY_TYPE], config.writeQueueSize),
+		writeThrough: config.writeThrough,
+		maxAttempts:  config.writeMaxAttempts,
+		backoff:      config.writeBackoff,
+		onFailure:    persistFailureHook,
+		retries:      &atomic.Uint64{},
+		failures:     &atomic.Uint64{},
+	}
+	for i := 0; i < config.writeWorkers; i++ {
+		go toReturn.writes.run()
+	}
+	if config.failureTTL > 0 {
+		toReturn.failureTTL = config.failureTTL
+	}
+
+	if config.unifiedSchema {
+		toReturn.store = newUnifiedStore(db, getterName, pendingTTL, valueTTL, maxConcurrentBatches, maxBatchSize)
+	} else {
+		toReturn.store = newLegacyStore(db, getterName, pendingTTL, valueTTL, config.staleTTL, maxConcurrentBatches, maxBatchSize)
+	}
+
+	toReturn.cancellers = append(toReturn.cancellers, multithread.Repeat(toReturn.reap, valueTTL/4, true))
+
+	// only invalidations made after this pod started matter, since its memory caches start out empty
+	toReturn.lastInvalidationID, err = toReturn.latestInvalidationID()
+	if err != nil {
+		_ = toReturn.Close(context.Background())
+		return nil, err
+	}
+	if config.invalidationPollInterval <= 0 {
+		config.invalidationPollInterval = defaultInvalidationPollInterval
+	}
+	toReturn.cancellers = append(toReturn.cancellers, multithread.Repeat(toReturn.pollInvalidations, config.invalidationPollInterval, false))
+
+	if config.slidingTTL > 0 {
+		if config.slidingFlushInterval <= 0 {
+			config.slidingFlushInterval = config.slidingTTL / 10
+		}
+		toReturn.sliding = newSlidingExpiration(config.slidingTTL, config.slidingFlushInterval)
+		toReturn.cancellers = append(toReturn.cancellers, multithread.Repeat(toReturn.flushTouches, config.slidingFlushInterval, false))
+	}
+
+	if config.refreshAheadWindow > 0 {
+		if config.refreshAheadMaxConcurrent <= 0 {
+			config.refreshAheadMaxConcurrent = 1
+		}
+		toReturn.refreshAhead = newRefreshAhead[KEY_TYPE](config.refreshAheadWindow, config.refreshAheadMinReads, config.refreshAheadMaxConcurrent)
+		toReturn.cancellers = append(toReturn.cancellers, multithread.Repeat(toReturn.refreshHotKeys, config.refreshAheadWindow, false))
+	}
 
-	toReturn.canceller = multithread.Repeat(toReturn.reap, valueTTL/4, true)
+	if config.workers > 0 {
+		if config.workerPollInterval <= 0 {
+			config.workerPollInterval = defaultWorkerPollInterval
+		}
+		toReturn.startWorkers(config.workers, config.workerPollInterval)
+	}
 
 	return &toReturn, nil
 }
 
+// resolves how long a freshly computed value should live
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) entryTTL(key KEY_TYPE, value VALUE_TYPE, getterTTL time.Duration) time.Duration {
+	if getterTTL > 0 {
+		return getterTTL
+	}
+	if tp.ttlFunc != nil {
+		if ttl := tp.ttlFunc(key, value); ttl > 0 {
+			return ttl
+		}
+	}
+	return tp.valueTTL
+}
+
 func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) reap() {
-	expiredCutoff := time.Now().Add(-tp.valueTTL)
-	dbc := tp.db.Where("key LIKE ?", tp.getterName+"-%").Where("created_at < ?", expiredCutoff).Delete(&PendingTask{})
+	now := time.Now()
+	expiredCutoff := now.Add(-tp.valueTTL)
+	err := tp.store.reap(now, tp.staleRetention())
+	if err != nil {
+		log.Printf("error clearing expired tasks: %v", err)
+	}
+	dbc := tp.db.Where("key LIKE ?", tp.getterName+"-%").Where("NOT " + tp.store.hasValueSQL("task_tags.key")).Delete(&TaskTag{})
 	if dbc.Error != nil {
-		log.Printf("error clearing expired pending task cache: %v", dbc.Error)
+		log.Printf("error clearing orphaned task tags: %v", dbc.Error)
 	}
-	dbc = tp.db.Where("key LIKE ?", tp.getterName+"-%").Where("created_at < ?", expiredCutoff).Delete(&CompletedTask{})
+	// only keys a worker took and nobody took again for valueTTL after its lease ran out; keys never picked up wait for a pod with workers
+	dbc = tp.db.Where("namespace = ?", tp.getterName).Where("leased_until < ?", expiredCutoff).Delete(&QueuedTask{})
 	if dbc.Error != nil {
-		log.Printf("error clearing expired completed task cache: %v", dbc.Error)
+		log.Printf("error clearing abandoned queued tasks: %v", dbc.Error)
+	} else if dbc.RowsAffected > 0 {
+		log.Printf("cleared %d abandoned queued tasks", dbc.RowsAffected)
 	}
-	dbc = tp.db.Where("key LIKE ?", tp.getterName+"-%").Where("created_at < ?", expiredCutoff).Delete(&FailedTask{})
+	dbc = tp.db.Where("namespace = ?", tp.getterName).Where("expires_at < ?", now).Delete(&GetterSlot{})
 	if dbc.Error != nil {
-		log.Printf("error clearing expired failed task cache: %v", dbc.Error)
+		log.Printf("error clearing expired getter slots: %v", dbc.Error)
+	}
+	dbc = tp.db.Where("namespace = ?", tp.getterName).Where("heartbeat_at < ?", now.Add(-tp.pendingTTL)).Delete(&GetterSlotWaiter{})
+	if dbc.Error != nil {
+		log.Printf("error clearing abandoned getter slot waiters: %v", dbc.Error)
+	}
+	dbc = tp.db.Where("namespace = ?", tp.getterName).Where("created_at < ?", now.Add(-invalidationRetention)).Delete(&Invalidation{})
+	if dbc.Error != nil {
+		log.Printf("error clearing old invalidations: %v", dbc.Error)
 	}
-}
-
-func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) Close() {
-	tp.canceller()
-	tp.completedCache.StopReaping()
-	tp.failureCache.StopReaping()
 }
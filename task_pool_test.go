@@ -1,9 +1,13 @@
 package deduplicate
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math/rand"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -166,3 +170,1224 @@ func TestGormGetter(t *testing.T) {
 		}),
 	)
 }
+
+// starts a database for a single test, which is stopped once the test (and its deferred cleanup) is done
+func setupTestDB(t *testing.T) *gorm.DB {
+	container, connectURL := dockerdb.SetupSuite()
+	t.Cleanup(func() { dockerdb.StopContainer(container) })
+
+	db, err := gorm.Open(postgres.Open(connectURL), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPerEntryTTL(t *testing.T) {
+	db := setupTestDB(t)
+
+	calls := 0
+	lock := &sync.Mutex{}
+	shortLivedTask := func(input SlowInput) (SlowOutput, time.Duration, error) {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		return SlowOutput{ID: input.ID, Name: strconv.Itoa(rand.Int())}, time.Second * 2, nil
+	}
+
+	pool, err := NewTaskPoolWithTTL(
+		db,
+		shortLivedTask,
+		time.Second*10,
+		time.Minute,
+		3,
+		9999,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	first, err := pool.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	second, err := pool.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	// the getter's TTL is much shorter than valueTTL, so the value must be recomputed once it passes
+	time.Sleep(time.Second * 3)
+	third, err := pool.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.Name, third.Name)
+
+	lock.Lock()
+	assert.Equal(t, 2, calls)
+	lock.Unlock()
+}
+
+func TestExpiredRowsNotServed(t *testing.T) {
+	db := setupTestDB(t)
+
+	calls := int64(0)
+	getter := func(input SlowInput) (SlowOutput, error) {
+		atomic.AddInt64(&calls, 1)
+		return quickTask(input)
+	}
+
+	pool1, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool1.Close(context.Background())
+
+	// separate pool to simulate a second pod, with nothing in memory
+	pool2, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool2.Close(context.Background())
+
+	first, err := pool1.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	_, err = pool1.Load(SlowInput{ID: "bad"})
+	assert.Error(t, err)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&calls))
+
+	// both rows expire, and the reaper (every valueTTL/4, after the pools' first pass) won't get to them during the test
+	time.Sleep(time.Millisecond * 200)
+	completedKey, err := pool1.getKeyStr(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	failedKey, err := pool1.getKeyStr(SlowInput{ID: "bad"})
+	assert.NoError(t, err)
+	expired := time.Now().Add(-time.Second)
+	assert.NoError(t, db.Model(&CompletedTask{}).Where("key = ?", completedKey).Update("expires_at", expired).Error)
+	assert.NoError(t, db.Model(&FailedTask{}).Where("key = ?", failedKey).Update("expires_at", expired).Error)
+
+	second, err := pool2.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.Name, second.Name)
+	_, err = pool2.Load(SlowInput{ID: "bad"})
+	assert.Error(t, err)
+	assert.Equal(t, int64(4), atomic.LoadInt64(&calls))
+}
+
+// slowTask without the wait; non-numeric IDs fail
+func quickTask(input SlowInput) (SlowOutput, error) {
+	otherId, err := strconv.Atoi(input.ID)
+	if err != nil {
+		return SlowOutput{}, err
+	}
+	return SlowOutput{ID: input.ID, Name: strconv.Itoa(rand.Int()), OtherId: otherId}, nil
+}
+
+func TestInvalidate(t *testing.T) {
+	db := setupTestDB(t)
+
+	pool1, err := NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999, WithInvalidationPollInterval(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool1.Close(context.Background())
+
+	// separate pool to simulate a second pod
+	pool2, err := NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999, WithInvalidationPollInterval(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool2.Close(context.Background())
+
+	original, err := pool1.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond * 100) // let the result be written
+	fromPool2, err := pool2.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, original, fromPool2)
+
+	assert.NoError(t, pool1.Invalidate(SlowInput{ID: "1"}))
+	time.Sleep(time.Second * 2) // give pool2 a chance to poll
+
+	recomputed, err := pool2.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, original.Name, recomputed.Name)
+}
+
+func TestPrime(t *testing.T) {
+	db := setupTestDB(t)
+
+	pool, err := NewTaskPool(db, deduplicationTester(t, quickTask), time.Second*10, time.Minute, 3, 9999, WithPrimePolicy(PrimeFailIfExists))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	primed := SlowOutput{ID: "1", Name: "primed"}
+	assert.NoError(t, pool.Prime(SlowInput{ID: "1"}, primed))
+	assert.ErrorIs(t, pool.Prime(SlowInput{ID: "1"}, primed), ErrAlreadyExists)
+
+	// a fresh pool has nothing in memory, so this must come from the primed row
+	other, err := NewTaskPool(db, deduplicationTester(t, quickTask), time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close(context.Background())
+	loaded, err := other.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, primed, loaded)
+
+	assert.NoError(t, pool.PrimeError(SlowInput{ID: "2"}, errors.New("vendor said no")))
+	_, err = other.Load(SlowInput{ID: "2"})
+	assert.ErrorContains(t, err, "vendor said no")
+}
+
+func TestTryLoadAndPeek(t *testing.T) {
+	db := setupTestDB(t)
+
+	pool, err := NewTaskPool(db, deduplicationTester(t, slowTask), time.Second*10, time.Minute, 3, 9999, WithPodID("test-pod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	status, err := pool.Peek(SlowInput{ID: "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, StateAbsent, status.State)
+
+	_, err = pool.TryLoad(SlowInput{ID: "3"})
+	assert.ErrorIs(t, err, ErrPending)
+
+	status, err = pool.Peek(SlowInput{ID: "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, StatePending, status.State)
+	assert.Equal(t, "test-pod", status.Owner)
+
+	time.Sleep(time.Second * 4)
+
+	value, err := pool.TryLoad(SlowInput{ID: "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, value.OtherId)
+
+	status, err = pool.Peek(SlowInput{ID: "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, StateCompleted, status.State)
+}
+
+func TestEnqueue(t *testing.T) {
+	db := setupTestDB(t)
+
+	deduplicationTrackingTask := deduplicationTester(t, quickTask)
+
+	// only the second pod runs workers
+	producer, err := NewTaskPool(db, deduplicationTrackingTask, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close(context.Background())
+	worker, err := NewTaskPool(db, deduplicationTrackingTask, time.Second*10, time.Minute, 3, 9999, WithWorkers(2, time.Millisecond*100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Close(context.Background())
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, producer.Enqueue(SlowInput{ID: strconv.Itoa(i)}))
+		assert.NoError(t, producer.Enqueue(SlowInput{ID: strconv.Itoa(i)}))
+	}
+
+	// a key leased by a worker that died is picked up once its lease runs out
+	assert.NoError(t, producer.Enqueue(SlowInput{ID: "5"}))
+	keyStr, err := producer.getKeyStr(SlowInput{ID: "5"})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Model(&QueuedTask{}).Where("key = ?", keyStr).Update("leased_until", time.Now().Add(time.Second)).Error)
+
+	time.Sleep(time.Second * 3)
+
+	for i := 0; i < 6; i++ {
+		status, err := producer.Peek(SlowInput{ID: strconv.Itoa(i)})
+		assert.NoError(t, err)
+		assert.Equal(t, StateCompleted, status.State)
+	}
+	queued := int64(0)
+	assert.NoError(t, db.Model(&QueuedTask{}).Count(&queued).Error)
+	assert.Equal(t, int64(0), queued)
+}
+
+func TestReapQueuedTasks(t *testing.T) {
+	db := setupTestDB(t)
+
+	// no workers, so nothing takes the keys before the reaper runs
+	pool, err := NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	assert.NoError(t, pool.Enqueue(SlowInput{ID: "1"}))
+	assert.NoError(t, pool.Enqueue(SlowInput{ID: "2"}))
+	waitingKey, err := pool.getKeyStr(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	abandonedKey, err := pool.getKeyStr(SlowInput{ID: "2"})
+	assert.NoError(t, err)
+	longAgo := time.Now().Add(-time.Minute * 2)
+	assert.NoError(t, db.Model(&QueuedTask{}).Where("key = ?", waitingKey).Update("created_at", longAgo).Error)
+	assert.NoError(t, db.Model(&QueuedTask{}).Where("key = ?", abandonedKey).Update("leased_until", longAgo).Error)
+
+	// a key no worker has taken yet is kept however old it is, while one whose lease ran out long ago is dropped
+	pool.reap()
+	remaining := []QueuedTask{}
+	assert.NoError(t, db.Find(&remaining).Error)
+	if assert.Len(t, remaining, 1) {
+		assert.Equal(t, waitingKey, remaining[0].Key)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	db := setupTestDB(t)
+
+	pool, err := NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999, WithRateLimit(RateLimit{PerSecond: 1, Burst: 1, DailyQuota: 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	_, err = pool.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+
+	_, err = pool.Load(SlowInput{ID: "2"})
+	assert.ErrorIs(t, err, ErrRateLimited)
+	var rateLimited RateLimitedError
+	assert.True(t, errors.As(err, &rateLimited))
+	assert.True(t, rateLimited.RetryAfter > 0)
+
+	value, err := pool.Load(SlowInput{ID: "2"}, WithRateLimitWait(true))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, value.OtherId)
+
+	stats, err := pool.Stats()
+	assert.NoError(t, err)
+	assert.NotNil(t, stats.RateLimit)
+	assert.Equal(t, 1, stats.RateLimit.DailyRemaining)
+}
+
+func TestMaxInFlight(t *testing.T) {
+	db := setupTestDB(t)
+
+	pool, err := NewTaskPool(db, slowTask, time.Second*10, time.Minute, 3, 9999, WithMaxInFlight(1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	_, err = pool.TryLoad(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, ErrPending)
+	_, err = pool.TryLoad(SlowInput{ID: "2"})
+	assert.ErrorIs(t, err, ErrPending)
+	time.Sleep(time.Millisecond * 500)
+
+	stats, err := pool.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.InFlight)
+	assert.Equal(t, 1, stats.Queued)
+
+	_, err = pool.Load(SlowInput{ID: "3"})
+	assert.ErrorIs(t, err, ErrOverloaded)
+}
+
+func TestGetterTimeout(t *testing.T) {
+	db := setupTestDB(t)
+
+	pool, err := NewTaskPool(db, slowTask, time.Second*10, time.Minute, 3, 9999, WithGetterTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+	other, err := NewTaskPool(db, slowTask, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close(context.Background())
+
+	startedAt := time.Now()
+	_, err = pool.Load(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, ErrGetterTimeout)
+	assert.Less(t, time.Since(startedAt), time.Second*2)
+
+	_, err = other.Load(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, ErrGetterTimeout)
+
+	value, err := pool.Load(SlowInput{ID: "2"}, WithTimeout(time.Second*5))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, value.OtherId)
+}
+
+func TestCancel(t *testing.T) {
+	db := setupTestDB(t)
+
+	pool, err := NewTaskPool(db, slowTask, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+	other, err := NewTaskPool(db, slowTask, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close(context.Background())
+
+	_, err = pool.TryLoad(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, ErrPending)
+	time.Sleep(time.Millisecond * 200)
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err := other.Load(SlowInput{ID: "1"})
+		waited <- err
+	}()
+	time.Sleep(time.Millisecond * 200)
+
+	assert.NoError(t, pool.Cancel(SlowInput{ID: "1"}))
+	status, err := pool.Peek(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, StateCancelled, status.State)
+	assert.ErrorIs(t, <-waited, ErrCancelled)
+
+	value, err := other.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, value.OtherId)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	db := setupTestDB(t)
+
+	var healthy atomic.Bool
+	getter := func(input SlowInput) (SlowOutput, error) {
+		if !healthy.Load() {
+			// an upstream timing out counts against the circuit like any other failure
+			return SlowOutput{}, fmt.Errorf("upstream is down: %w", context.DeadlineExceeded)
+		}
+		return quickTask(input)
+	}
+	pool, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999, WithCircuitBreaker(CircuitBreaker{MinRequests: 2, OpenFor: time.Second}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	for _, id := range []string{"1", "2"} {
+		_, err = pool.Load(SlowInput{ID: id})
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+	_, err = pool.Load(SlowInput{ID: "3"})
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	healthy.Store(true)
+	time.Sleep(time.Second + time.Millisecond*100)
+	value, err := pool.Load(SlowInput{ID: "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, value.OtherId)
+
+	stats, err := pool.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, CircuitClosed, stats.CircuitBreaker.State)
+}
+
+func TestClose(t *testing.T) {
+	db := setupTestDB(t)
+
+	pool, err := NewTaskPool(db, slowTask, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = pool.TryLoad(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, ErrPending)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	assert.NoError(t, pool.Close(ctx))
+
+	_, err = pool.Load(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, pool.Close(ctx), ErrClosed)
+
+	other, err := NewTaskPool(db, slowTask, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close(context.Background())
+
+	result, err := other.LoadWithMeta(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, SourceDatabase, result.Source)
+}
+
+func TestLoadWithMeta(t *testing.T) {
+	db := setupTestDB(t)
+
+	getter := func(input SlowInput) (SlowOutput, error) {
+		time.Sleep(time.Millisecond * 200)
+		return quickTask(input)
+	}
+
+	pool1, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999, WithPodID("pod-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool1.Close(context.Background())
+
+	// separate pool to simulate a second pod
+	pool2, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999, WithPodID("pod-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool2.Close(context.Background())
+
+	before := time.Now()
+	computed, err := pool1.LoadWithMeta(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, SourceGetter, computed.Source)
+	assert.Equal(t, "pod-1", computed.ComputedBy)
+	assert.GreaterOrEqual(t, computed.GetterDuration, time.Millisecond*200)
+	assert.WithinRange(t, computed.CreatedAt, before, time.Now())
+	assert.WithinDuration(t, computed.CreatedAt.Add(time.Minute), computed.ExpiresAt, time.Millisecond)
+
+	// the other pod reads the same metadata back from the database
+	loaded, err := pool2.LoadWithMeta(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, SourceDatabase, loaded.Source)
+	assert.Equal(t, computed.Value, loaded.Value)
+	assert.Equal(t, "pod-1", loaded.ComputedBy)
+	assert.Equal(t, computed.GetterDuration, loaded.GetterDuration)
+	assert.WithinDuration(t, computed.CreatedAt, loaded.CreatedAt, time.Millisecond)
+	assert.WithinDuration(t, computed.ExpiresAt, loaded.ExpiresAt, time.Millisecond)
+}
+
+func TestWriteThrough(t *testing.T) {
+	db := setupTestDB(t)
+
+	failures := make(chan PersistFailure[SlowInput], 10)
+	pool, err := NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999,
+		WithWriteRetries(2, time.Millisecond),
+		WithPersistFailureHook(func(failure PersistFailure[SlowInput]) { failures <- failure }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	value, err := pool.Load(SlowInput{ID: "1"}, WithDurableWrite())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, value.OtherId)
+	status, err := pool.Peek(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, StateCompleted, status.State)
+
+	assert.NoError(t, db.Migrator().DropTable(&CompletedTask{}))
+	value, err = pool.Load(SlowInput{ID: "2"}, WithDurableWrite())
+	assert.ErrorIs(t, err, ErrNotPersisted)
+	assert.Equal(t, 2, value.OtherId)
+	assert.Len(t, failures, 2)
+
+	stats, err := pool.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Writes.Retries)
+	assert.Equal(t, uint64(1), stats.Writes.Failures)
+}
+
+func TestCompletionClearsPendingTask(t *testing.T) {
+	db := setupTestDB(t)
+
+	pool, err := NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999, WithWriteThrough())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	// an expired failure that hasn't been reaped yet
+	keyStr, err := pool.getKeyStr(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Create(&FailedTask{Key: keyStr, CreatedAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().Add(-time.Minute), ErrorString: "old"}).Error)
+
+	_, err = pool.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+
+	var pending, failed int64
+	assert.NoError(t, db.Model(&PendingTask{}).Count(&pending).Error)
+	assert.NoError(t, db.Model(&FailedTask{}).Count(&failed).Error)
+	assert.Equal(t, int64(0), pending)
+	assert.Equal(t, int64(0), failed)
+
+	_, err = pool.Load(SlowInput{ID: "bad"})
+	assert.Error(t, err)
+	time.Sleep(time.Millisecond * 100)
+	assert.NoError(t, db.Model(&PendingTask{}).Count(&pending).Error)
+	assert.NoError(t, db.Model(&FailedTask{}).Count(&failed).Error)
+	assert.Equal(t, int64(0), pending)
+	assert.Equal(t, int64(1), failed)
+}
+
+func TestUnifiedSchema(t *testing.T) {
+	db := setupTestDB(t)
+
+	legacy, err := NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999, WithWriteThrough())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	_, err = legacy.Load(SlowInput{ID: "bad"})
+	assert.Error(t, err)
+	assert.NoError(t, legacy.Close(context.Background()))
+
+	assert.NoError(t, MigrateToUnifiedSchema(db))
+
+	pool, err := NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999, WithUnifiedSchema(), WithWriteThrough())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	// migrated rows are served without calling the getter again
+	result, err := pool.LoadWithMeta(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, SourceDatabase, result.Source)
+	assert.Equal(t, 1, result.Value.OtherId)
+	status, err := pool.Peek(SlowInput{ID: "bad"})
+	assert.NoError(t, err)
+	assert.Equal(t, StateFailed, status.State)
+
+	value, err := pool.Load(SlowInput{ID: "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, value.OtherId)
+	keyStr, err := pool.getKeyStr(SlowInput{ID: "2"})
+	assert.NoError(t, err)
+	task := Task{}
+	assert.NoError(t, db.Where("key = ?", keyStr).First(&task).Error)
+	assert.Equal(t, TaskCompleted, task.State)
+	assert.Equal(t, "", task.Owner)
+	assert.Equal(t, 1, task.Attempts)
+
+	assert.NoError(t, pool.Invalidate(SlowInput{ID: "2"}))
+	status, err = pool.Peek(SlowInput{ID: "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, StateAbsent, status.State)
+}
+
+func TestMigrate(t *testing.T) {
+	db := setupTestDB(t)
+
+	// nothing has been migrated yet
+	_, err := NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999, WithoutAutoMigrate())
+	assert.ErrorIs(t, err, ErrSchemaMissing)
+
+	// pods migrating at the same time take turns
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, Migrate(db))
+		}()
+	}
+	wg.Wait()
+
+	for _, opts := range [][]Option{{WithoutAutoMigrate()}, {WithoutAutoMigrate(), WithUnifiedSchema()}} {
+		pool, err := NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := pool.Load(SlowInput{ID: "1"}, WithDurableWrite())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, value.OtherId)
+		assert.NoError(t, pool.InvalidateAll())
+		assert.NoError(t, pool.Close(context.Background()))
+	}
+
+	assert.NoError(t, db.Migrator().DropIndex(&CompletedTask{}, "idx_completed_tasks_expires_at"))
+	_, err = NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999, WithoutAutoMigrate())
+	assert.ErrorIs(t, err, ErrSchemaMissing)
+	assert.ErrorContains(t, err, "index idx_completed_tasks_expires_at")
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	db := setupTestDB(t)
+
+	pool, err := NewTaskPool(db, quickTask, time.Second*10, time.Second*2, 3, 9999, WithSlidingExpiration(time.Second*2, time.Millisecond*200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	first, err := pool.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	// reading the key keeps it alive well past valueTTL
+	for i := 0; i < 8; i++ {
+		time.Sleep(time.Millisecond * 500)
+		value, err := pool.Load(SlowInput{ID: "1"})
+		assert.NoError(t, err)
+		assert.Equal(t, first, value)
+	}
+
+	// the extension reached the database, so another pod sees it too
+	other, err := NewTaskPool(db, quickTask, time.Second*10, time.Second*2, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close(context.Background())
+	value, err := other.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, first, value)
+
+	// once nobody reads it, it expires
+	time.Sleep(time.Second * 3)
+	value, err = pool.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.Name, value.Name)
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	db := setupTestDB(t)
+
+	var calls atomic.Int32
+	var failing atomic.Bool
+	getter := func(input SlowInput) (SlowOutput, time.Duration, error) {
+		calls.Add(1)
+		if failing.Load() {
+			return SlowOutput{}, 0, errors.New("vendor is down")
+		}
+		return SlowOutput{ID: input.ID, Name: strconv.Itoa(rand.Int())}, time.Second, nil
+	}
+	pool, err := NewTaskPoolWithTTL(db, getter, time.Second*10, time.Minute, 3, 9999, WithStaleWhileRevalidate(time.Second*2), WithFailureTTL(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	first, err := pool.LoadWithMeta(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.False(t, first.Stale)
+
+	// a stale value comes back right away, and is refreshed in the background
+	time.Sleep(time.Millisecond * 1500)
+	stale, err := pool.LoadWithMeta(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.True(t, stale.Stale)
+	assert.Equal(t, first.Value, stale.Value)
+	time.Sleep(time.Millisecond * 500)
+	refreshed, err := pool.LoadWithMeta(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.False(t, refreshed.Stale)
+	assert.NotEqual(t, first.Value.Name, refreshed.Value.Name)
+	assert.Equal(t, int32(2), calls.Load())
+
+	// a failed refresh is stored rather than left pending, so readers get the failure once the stale value runs out instead of waiting on it
+	failing.Store(true)
+	time.Sleep(time.Millisecond * 1500)
+	stale, err = pool.LoadWithMeta(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.True(t, stale.Stale)
+	time.Sleep(time.Millisecond * 500)
+	var pending int64
+	assert.NoError(t, db.Model(&PendingTask{}).Count(&pending).Error)
+	assert.Equal(t, int64(0), pending)
+
+	time.Sleep(time.Second * 2)
+	start := time.Now()
+	_, err = pool.Load(SlowInput{ID: "1"})
+	assert.ErrorContains(t, err, "vendor is down")
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestStaleIfError(t *testing.T) {
+	db := setupTestDB(t)
+
+	var failing atomic.Bool
+	getter := func(input SlowInput) (SlowOutput, time.Duration, error) {
+		if failing.Load() {
+			return SlowOutput{}, 0, errors.New("vendor is down")
+		}
+		return SlowOutput{ID: input.ID, Name: strconv.Itoa(rand.Int())}, time.Second, nil
+	}
+	pool, err := NewTaskPoolWithTTL(db, getter, time.Second*10, time.Minute, 3, 9999, WithStaleIfError(time.Second*2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	first, err := pool.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+
+	failing.Store(true)
+	time.Sleep(time.Millisecond * 1500)
+	result, err := pool.LoadWithMeta(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, ErrStale)
+	assert.ErrorContains(t, err, "vendor is down")
+	assert.True(t, result.Stale)
+	assert.Equal(t, first, result.Value)
+
+	// the failure is still recorded
+	status, err := pool.Peek(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, StateFailed, status.State)
+
+	// once the grace period is over, the error comes back on its own
+	time.Sleep(time.Second * 2)
+	_, err = pool.Load(SlowInput{ID: "1"})
+	assert.ErrorContains(t, err, "vendor is down")
+	assert.NotErrorIs(t, err, ErrStale)
+}
+
+func TestRefreshAhead(t *testing.T) {
+	db := setupTestDB(t)
+
+	getter := func(input SlowInput) (SlowOutput, time.Duration, error) {
+		return SlowOutput{ID: input.ID, Name: strconv.Itoa(rand.Int())}, time.Millisecond * 1500, nil
+	}
+	pool, err := NewTaskPoolWithTTL(db, getter, time.Second*10, time.Minute, 3, 9999, WithRefreshAhead(time.Second, 2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	first, err := pool.LoadWithMeta(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, SourceGetter, first.Source)
+
+	// a hot key is recomputed before it expires, so readers never run the getter themselves
+	last := first
+	for i := 0; i < 20; i++ {
+		time.Sleep(time.Millisecond * 200)
+		last, err = pool.LoadWithMeta(SlowInput{ID: "1"})
+		assert.NoError(t, err)
+		assert.NotEqual(t, SourceGetter, last.Source)
+		assert.False(t, last.Stale)
+	}
+	assert.NotEqual(t, first.Value.Name, last.Value.Name)
+}
+
+func TestInvalidateTag(t *testing.T) {
+	db := setupTestDB(t)
+
+	tagsFunc := WithTagsFunc(func(input SlowInput, output SlowOutput) []string {
+		if input.ID == "1" {
+			return []string{"odd", "first"}
+		}
+		return []string{"odd"}
+	})
+	pool1, err := NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999, tagsFunc, WithInvalidationPollInterval(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool1.Close(context.Background())
+
+	// separate pool to simulate a second pod
+	pool2, err := NewTaskPool(db, quickTask, time.Second*10, time.Minute, 3, 9999, tagsFunc, WithInvalidationPollInterval(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool2.Close(context.Background())
+
+	first, err := pool1.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	third, err := pool1.Load(SlowInput{ID: "3"})
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond * 100) // let the results be written
+	fromPool2, err := pool2.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, first, fromPool2)
+	fromPool2, err = pool2.Load(SlowInput{ID: "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, third, fromPool2)
+
+	assert.NoError(t, pool1.InvalidateTag("first"))
+	time.Sleep(time.Second * 2) // give pool2 a chance to poll
+
+	// only the tagged key is evicted from the other pod's memory
+	recomputed, err := pool2.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, first.Name, recomputed.Name)
+	untouched, err := pool2.Load(SlowInput{ID: "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, third, untouched)
+}
+
+func TestWatch(t *testing.T) {
+	db := setupTestDB(t)
+
+	calls := int64(0)
+	getter := func(input SlowInput) (SlowOutput, error) {
+		atomic.AddInt64(&calls, 1)
+		time.Sleep(time.Millisecond * 500)
+		return SlowOutput{ID: input.ID, Name: strconv.Itoa(rand.Int())}, nil
+	}
+	pool, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	// every subscriber gets the one shared result exactly once, then its channel is closed
+	first := pool.Watch(context.Background(), SlowInput{ID: "1"})
+	second := pool.Watch(context.Background(), SlowInput{ID: "1"})
+	fromFirst, ok := <-first
+	assert.True(t, ok)
+	assert.NoError(t, fromFirst.Err)
+	fromSecond, ok := <-second
+	assert.True(t, ok)
+	assert.Equal(t, fromFirst.Value, fromSecond.Value)
+	_, ok = <-first
+	assert.False(t, ok)
+	_, ok = <-second
+	assert.False(t, ok)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&calls))
+
+	// leaving closes the channel without a delivery, but the getter it started still finishes for everyone else
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := pool.Watch(ctx, SlowInput{ID: "2"})
+	time.Sleep(time.Millisecond * 100)
+	cancel()
+	_, ok = <-abandoned
+	assert.False(t, ok)
+	_, err = pool.Load(SlowInput{ID: "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&calls))
+}
+
+func TestPriority(t *testing.T) {
+	db := setupTestDB(t)
+
+	order := make(chan string, 10)
+	getter := func(input SlowInput) (SlowOutput, error) {
+		order <- input.ID
+		time.Sleep(time.Millisecond * 500)
+		return SlowOutput{ID: input.ID, Name: strconv.Itoa(rand.Int())}, nil
+	}
+
+	producer, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close(context.Background())
+
+	assert.NoError(t, producer.Enqueue(SlowInput{ID: "backfill"}, WithPriority(PriorityLow)))
+	assert.NoError(t, producer.Enqueue(SlowInput{ID: "normal"}))
+	assert.NoError(t, producer.Enqueue(SlowInput{ID: "interactive"}, WithPriority(PriorityHigh)))
+
+	// a single worker picks the most urgent queued key first
+	worker, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999, WithWorkers(1, time.Millisecond*100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Close(context.Background())
+	assert.Equal(t, "interactive", <-order)
+	assert.Equal(t, "normal", <-order)
+	assert.Equal(t, "backfill", <-order)
+
+	// a caller waiting on a pending task raises its priority to its own
+	_, err = producer.TryLoad(SlowInput{ID: "raised"}, WithPriority(PriorityLow))
+	assert.ErrorIs(t, err, ErrPending)
+	status, err := producer.Peek(SlowInput{ID: "raised"})
+	assert.NoError(t, err)
+	assert.Equal(t, StatePending, status.State)
+	assert.Equal(t, PriorityLow, status.Priority)
+	go func() { _, _ = worker.Load(SlowInput{ID: "raised"}, WithPriority(PriorityHigh)) }()
+	time.Sleep(time.Millisecond * 200)
+	status, err = producer.Peek(SlowInput{ID: "raised"})
+	assert.NoError(t, err)
+	assert.Equal(t, PriorityHigh, status.Priority)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	db := setupTestDB(t)
+
+	running := int64(0)
+	maxRunning := int64(0)
+	order := make(chan string, 10)
+	getter := func(input SlowInput) (SlowOutput, error) {
+		now := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			seen := atomic.LoadInt64(&maxRunning)
+			if now <= seen || atomic.CompareAndSwapInt64(&maxRunning, seen, now) {
+				break
+			}
+		}
+		order <- input.ID
+		time.Sleep(time.Millisecond * 500)
+		return SlowOutput{ID: input.ID, Name: strconv.Itoa(rand.Int())}, nil
+	}
+
+	pool1, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999, WithConcurrencyLimit(1, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool1.Close(context.Background())
+
+	// separate pool to simulate a second pod
+	pool2, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999, WithConcurrencyLimit(1, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool2.Close(context.Background())
+
+	wg := sync.WaitGroup{}
+	load := func(pool *TaskPool[SlowInput, SlowOutput], id string, priority Priority) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pool.Load(SlowInput{ID: id}, WithPriority(priority))
+			assert.NoError(t, err)
+		}()
+	}
+
+	// the first getter holds the only slot, so the other two queue up behind it across both pods
+	load(pool1, "first", PriorityNormal)
+	time.Sleep(time.Millisecond * 200)
+	load(pool2, "low", PriorityLow)
+	time.Sleep(time.Millisecond * 200)
+	load(pool1, "high", PriorityHigh)
+	wg.Wait()
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&maxRunning))
+	assert.Equal(t, "first", <-order)
+	assert.Equal(t, "high", <-order)
+	assert.Equal(t, "low", <-order)
+}
+
+func TestHungGetter(t *testing.T) {
+	db := setupTestDB(t)
+
+	release := make(chan struct{})
+	getter := func(input SlowInput) (SlowOutput, error) {
+		<-release
+		return quickTask(input)
+	}
+
+	pool1, err := NewTaskPool(db, getter, time.Second*2, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool1.Close(context.Background())
+
+	// separate pool to simulate a second pod
+	pool2, err := NewTaskPool(db, getter, time.Second*2, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool2.Close(context.Background())
+	defer close(release) // lets the pools close
+
+	// the claim is only renewed while waiting for capacity, so a getter that never returns doesn't keep waiters waiting forever
+	_, err = pool1.TryLoad(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, ErrPending)
+	_, err = pool2.Load(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, errPendingTimeout)
+}
+
+func TestPrimeDuringGetter(t *testing.T) {
+	db := setupTestDB(t)
+
+	release := make(chan struct{})
+	getter := func(input SlowInput) (SlowOutput, error) {
+		<-release
+		return quickTask(input)
+	}
+	pool, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	_, err = pool.TryLoad(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, ErrPending)
+	primed := SlowOutput{ID: "1", Name: "primed"}
+	assert.NoError(t, pool.Prime(SlowInput{ID: "1"}, primed))
+
+	// the getter finishing after the prime doesn't overwrite the primed value, in the database or in memory
+	close(release)
+	time.Sleep(time.Millisecond * 200)
+	loaded, err := pool.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, primed, loaded)
+
+	other, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close(context.Background())
+	loaded, err = other.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, primed, loaded)
+}
+
+func TestPrimeFailIfExistsConflicts(t *testing.T) {
+	db := setupTestDB(t)
+
+	release := make(chan struct{})
+	getter := func(input SlowInput) (SlowOutput, error) {
+		<-release
+		return quickTask(input)
+	}
+	pool, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999, WithPrimePolicy(PrimeFailIfExists))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+	defer close(release)
+
+	// of several primes racing for the same key, exactly one wins
+	var stored, conflicts atomic.Int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := pool.Prime(SlowInput{ID: "1"}, SlowOutput{ID: "1", Name: strconv.Itoa(i)})
+			if errors.Is(err, ErrAlreadyExists) {
+				conflicts.Add(1)
+			} else if assert.NoError(t, err) {
+				stored.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1), stored.Load())
+	assert.Equal(t, int64(9), conflicts.Load())
+
+	// a getter in flight holds its key too
+	_, err = pool.TryLoad(SlowInput{ID: "2"})
+	assert.ErrorIs(t, err, ErrPending)
+	assert.ErrorIs(t, pool.Prime(SlowInput{ID: "2"}, SlowOutput{ID: "2", Name: "primed"}), ErrAlreadyExists)
+}
+
+func TestInvalidateDuringGetter(t *testing.T) {
+	db := setupTestDB(t)
+
+	release := make(chan struct{})
+	calls := int64(0)
+	getter := func(input SlowInput) (SlowOutput, error) {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			<-release
+			return SlowOutput{ID: input.ID, Name: "stale"}, nil
+		}
+		return SlowOutput{ID: input.ID, Name: "fresh"}, nil
+	}
+	pool, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close(context.Background())
+
+	_, err = pool.TryLoad(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, ErrPending)
+	time.Sleep(time.Millisecond * 100) // let the getter start
+	assert.NoError(t, pool.Invalidate(SlowInput{ID: "1"}))
+
+	// the getter that started before the invalidation finishes after it, and its result is dropped
+	close(release)
+	time.Sleep(time.Millisecond * 200)
+	status, err := pool.Peek(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, StateAbsent, status.State)
+	loaded, err := pool.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "fresh", loaded.Name)
+}
+
+func TestUnpersistedResultReleasesClaim(t *testing.T) {
+	db := setupTestDB(t)
+
+	// a second connection whose writes of completed tasks always fail, sharing the first's database
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failingDB, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = failingDB.Callback().Create().Before("gorm:create").Register("fail_completed_tasks", func(tx *gorm.DB) {
+		if tx.Statement.Table == "completed_tasks" {
+			_ = tx.AddError(errors.New("disk full"))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := int64(0)
+	getter := func(input SlowInput) (SlowOutput, error) {
+		atomic.AddInt64(&calls, 1)
+		time.Sleep(time.Millisecond * 500)
+		return quickTask(input)
+	}
+	pool1, err := NewTaskPool(failingDB, getter, time.Second*10, time.Minute, 3, 9999, WithWriteRetries(2, time.Millisecond*10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool1.Close(context.Background())
+
+	// separate pool to simulate a second pod
+	pool2, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool2.Close(context.Background())
+
+	_, err = pool1.TryLoad(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, ErrPending)
+	time.Sleep(time.Millisecond * 100)
+
+	// once pool1 gives up storing its result, pool2 stops waiting on its claim and computes the key itself
+	startedAt := time.Now()
+	value, err := pool2.Load(SlowInput{ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, value.OtherId)
+	assert.Less(t, time.Since(startedAt), time.Second*5)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&calls))
+}
+
+func TestCloseReleasesCapacityWaits(t *testing.T) {
+	db := setupTestDB(t)
+
+	release := make(chan struct{})
+	getter := func(input SlowInput) (SlowOutput, error) {
+		<-release
+		return quickTask(input)
+	}
+
+	pool1, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999, WithConcurrencyLimit(1, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool1.Close(context.Background())
+
+	// separate pool to simulate a second pod
+	pool2, err := NewTaskPool(db, getter, time.Second*10, time.Minute, 3, 9999, WithConcurrencyLimit(1, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool2.Close(context.Background())
+	defer close(release) // lets the pools close
+
+	// pool1 holds the only slot, so pool2's getter waits for it with no deadline
+	_, err = pool1.TryLoad(SlowInput{ID: "1"})
+	assert.ErrorIs(t, err, ErrPending)
+	time.Sleep(time.Millisecond * 200)
+	loadErr := make(chan error, 1)
+	go func() {
+		_, err := pool2.Load(SlowInput{ID: "2"})
+		loadErr <- err
+	}()
+	time.Sleep(time.Millisecond * 200)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	start := time.Now()
+	assert.NoError(t, pool2.Close(ctx))
+	assert.Less(t, time.Since(start), time.Second*2)
+	assert.ErrorIs(t, <-loadErr, ErrClosed)
+}
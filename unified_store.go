@@ -0,0 +1,409 @@
+package deduplicate
+
+import (
+	"time"
+
+	"github.com/nuvi/go-dataloader"
+	gormLoader "github.com/nuvi/go-dataloader/gorm"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// the last transition a Task went through
+type TaskState string
+
+const (
+	TaskPending   TaskState = "pending"
+	TaskCompleted TaskState = "completed"
+	TaskFailed    TaskState = "failed"
+)
+
+// everything the unified schema (see WithUnifiedSchema) knows about one key
+// a value outlives later claims and failures so that it can still be served stale, and a row is deleted once nothing in it is live
+type Task struct {
+	Key   string `gorm:"primaryKey"`
+	State TaskState
+
+	// the lease; an empty owner means nobody holds a claim
+	Owner     string
+	ClaimID   string
+	ClaimedAt time.Time
+	Priority  Priority
+	Cancelled bool
+	// how many times the key has been claimed since the row was created
+	Attempts int
+
+	// set while the row holds a value
+	ValueExpiresAt *time.Time `gorm:"index"`
+	ValueCreatedAt time.Time
+	Value          string
+	ComputedBy     string
+	GetterDuration time.Duration
+
+	// set while the row holds a failure
+	FailureExpiresAt *time.Time `gorm:"index"`
+	FailedAt         time.Time
+	ErrorString      string
+	TimedOut         bool
+}
+
+// the state a row falls back to once its claim is given up
+const settledTaskStateSQL = "CASE WHEN failure_expires_at IS NOT NULL THEN 'failed' WHEN value_expires_at IS NOT NULL THEN 'completed' ELSE 'pending' END"
+
+func taskFromCompleted(completedTask CompletedTask) Task {
+	expiresAt := completedTask.ExpiresAt
+	return Task{
+		Key:            completedTask.Key,
+		State:          TaskCompleted,
+		ValueExpiresAt: &expiresAt,
+		ValueCreatedAt: completedTask.CreatedAt,
+		Value:          completedTask.Value,
+		ComputedBy:     completedTask.ComputedBy,
+		GetterDuration: completedTask.GetterDuration,
+	}
+}
+
+func taskFromFailed(failedTask FailedTask) Task {
+	expiresAt := failedTask.ExpiresAt
+	return Task{
+		Key:              failedTask.Key,
+		State:            TaskFailed,
+		FailureExpiresAt: &expiresAt,
+		FailedAt:         failedTask.CreatedAt,
+		ErrorString:      failedTask.ErrorString,
+		TimedOut:         failedTask.TimedOut,
+	}
+}
+
+func (task Task) rows() taskRows {
+	rows := taskRows{}
+	if task.Owner != "" {
+		rows.pending = &PendingTask{
+			Key:       task.Key,
+			CreatedAt: task.ClaimedAt,
+			Owner:     task.Owner,
+			ClaimID:   task.ClaimID,
+			Priority:  task.Priority,
+			Cancelled: task.Cancelled,
+		}
+	}
+	if task.ValueExpiresAt != nil {
+		rows.completed = &CompletedTask{
+			Key:            task.Key,
+			CreatedAt:      task.ValueCreatedAt,
+			ExpiresAt:      *task.ValueExpiresAt,
+			Value:          task.Value,
+			ComputedBy:     task.ComputedBy,
+			GetterDuration: task.GetterDuration,
+		}
+	}
+	if task.FailureExpiresAt != nil {
+		rows.failed = &FailedTask{
+			Key:         task.Key,
+			CreatedAt:   task.FailedAt,
+			ExpiresAt:   *task.FailureExpiresAt,
+			ErrorString: task.ErrorString,
+			TimedOut:    task.TimedOut,
+		}
+	}
+	return rows
+}
+
+// keeps each key's claim, value and failure in a single row of the tasks table, so that finding out where a key stands is one lookup
+type unifiedStore struct {
+	db         *gorm.DB
+	namespace  string
+	pendingTTL time.Duration
+	valueTTL   time.Duration
+
+	taskBatcher *dataloader.QueryBatcher[string, Task]
+}
+
+func newUnifiedStore(db *gorm.DB, namespace string, pendingTTL time.Duration, valueTTL time.Duration, maxConcurrentBatches int, maxBatchSize int) *unifiedStore {
+	return &unifiedStore{
+		db:         db,
+		namespace:  namespace,
+		pendingTTL: pendingTTL,
+		valueTTL:   valueTTL,
+
+		taskBatcher: dataloader.NewQueryBatcher(
+			gormLoader.GormGetter(db, "key", func(task Task) string { return task.Key }),
+			maxConcurrentBatches,
+			maxBatchSize,
+		),
+	}
+}
+
+func (us *unifiedStore) inNamespace(db *gorm.DB) *gorm.DB {
+	return db.Where("key LIKE ?", us.namespace+"-%")
+}
+
+func unifiedModels() []any {
+	return []any{&Task{}}
+}
+
+func (us *unifiedStore) lookup(keyStr string, withPending bool, now time.Time) (taskRows, error) {
+	task, err := missingAsNil(us.taskBatcher.Load(keyStr))
+	if err != nil || task == nil {
+		return taskRows{}, err
+	}
+	rows := task.rows()
+	if rows.failed != nil && !isLiveFailure(*rows.failed, us.valueTTL, now) {
+		rows.failed = nil
+	}
+	if !withPending {
+		rows.pending = nil
+	}
+	return rows, nil
+}
+
+func (us *unifiedStore) getPending(keyStr string) (PendingTask, error) {
+	task, err := us.taskBatcher.Load(keyStr)
+	if err != nil {
+		return PendingTask{}, err
+	}
+	rows := task.rows()
+	if rows.pending == nil {
+		return PendingTask{}, dataloader.ErrMissingResponse
+	}
+	return *rows.pending, nil
+}
+
+func (us *unifiedStore) claim(keyStr string, owner string, claimID string, priority Priority, now time.Time) (bool, error) {
+	result := us.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "key"}},
+		DoUpdates: append(
+			clause.AssignmentColumns([]string{"state", "owner", "claim_id", "claimed_at", "priority", "cancelled"}),
+			clause.Assignment{Column: clause.Column{Name: "attempts"}, Value: gorm.Expr("tasks.attempts + 1")},
+		),
+		Where: clause.Where{Exprs: []clause.Expression{gorm.Expr(
+			"tasks.owner = '' OR tasks.claimed_at < ? OR tasks.cancelled", now.Add(-us.pendingTTL),
+		)}},
+	}).Create(&Task{
+		Key:       keyStr,
+		State:     TaskPending,
+		Owner:     owner,
+		ClaimID:   claimID,
+		ClaimedAt: now,
+		Priority:  priority,
+		Attempts:  1,
+	})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (us *unifiedStore) raisePriority(keyStr string, priority Priority) error {
+	return us.db.Model(&Task{}).Where("key = ? AND owner <> '' AND priority < ?", keyStr, priority).Update("priority", priority).Error
+}
+
+// rows that held nothing but a claim have nothing left once it's given up
+func (us *unifiedStore) deleteSettled(tx *gorm.DB, scope func(*gorm.DB) *gorm.DB) error {
+	return tx.Scopes(scope).Where("owner = '' AND value_expires_at IS NULL AND failure_expires_at IS NULL").Delete(&Task{}).Error
+}
+
+// gives up the claims matching claims, then deletes whatever is left empty within scope
+func (us *unifiedStore) releaseWhere(scope func(*gorm.DB) *gorm.DB, claims func(*gorm.DB) *gorm.DB) error {
+	return us.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Task{}).Scopes(scope, claims).Where("owner <> ''").Updates(map[string]any{
+			"state":     gorm.Expr(settledTaskStateSQL),
+			"owner":     "",
+			"claim_id":  "",
+			"cancelled": false,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		return us.deleteSettled(tx, scope)
+	})
+}
+
+func (us *unifiedStore) renew(keyStr string, claimID string, now time.Time) error {
+	return us.db.Model(&Task{}).Where("key = ? AND claim_id = ? AND NOT cancelled", keyStr, claimID).Update("claimed_at", now).Error
+}
+
+func (us *unifiedStore) release(keyStr string, claimID string) error {
+	return us.releaseWhere(
+		func(db *gorm.DB) *gorm.DB { return db.Where("key = ?", keyStr) },
+		func(db *gorm.DB) *gorm.DB { return db.Where("key = ? AND claim_id = ?", keyStr, claimID) },
+	)
+}
+
+func (us *unifiedStore) releaseOwned(owner string) error {
+	return us.releaseWhere(us.inNamespace, func(db *gorm.DB) *gorm.DB { return db.Where("owner = ? AND NOT cancelled", owner) })
+}
+
+func (us *unifiedStore) cancel(tx *gorm.DB, keyStr string) error {
+	return tx.Model(&Task{}).Where("key = ? AND owner <> ''", keyStr).Update("cancelled", true).Error
+}
+
+// the columns holding a value, and those holding a failure
+var (
+	taskValueColumns   = []string{"value_expires_at", "value_created_at", "value", "computed_by", "getter_duration"}
+	taskFailureColumns = []string{"failure_expires_at", "failed_at", "error_string", "timed_out"}
+)
+
+// stores an outcome, replacing the given columns, and ends the claim it was computed under
+// the row is only updated while it still holds that claim, so an outcome never lands on a row that was primed over, invalidated or claimed again since
+func (us *unifiedStore) settle(tx *gorm.DB, task Task, claimID string, columns []string) error {
+	result := tx.Model(&Task{}).
+		Where("key = ? AND claim_id = ?", task.Key, claimID).
+		Select(append([]string{"state", "owner", "claim_id", "cancelled"}, columns...)).
+		Updates(task)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errClaimLost
+	}
+	return nil
+}
+
+func (us *unifiedStore) complete(tx *gorm.DB, completedTask CompletedTask, claimID string) error {
+	// a newer value makes any earlier failure moot
+	return us.settle(tx, taskFromCompleted(completedTask), claimID, append(taskValueColumns, taskFailureColumns...))
+}
+
+func (us *unifiedStore) fail(tx *gorm.DB, failedTask FailedTask, claimID string) error {
+	// the value is kept, so it can still be served stale
+	return us.settle(tx, taskFromFailed(failedTask), claimID, taskFailureColumns)
+}
+
+func (us *unifiedStore) put(tx *gorm.DB, tasks []Task) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "key"}},
+		// everything but the attempt count is replaced, claims included
+		DoUpdates: clause.AssignmentColumns(append([]string{"state", "owner", "claim_id", "claimed_at", "priority", "cancelled"}, append(taskValueColumns, taskFailureColumns...)...)),
+	}).Create(&tasks).Error
+}
+
+func (us *unifiedStore) putCompleted(tx *gorm.DB, completedTasks []CompletedTask) error {
+	tasks := make([]Task, len(completedTasks))
+	for i, completedTask := range completedTasks {
+		tasks[i] = taskFromCompleted(completedTask)
+	}
+	return us.put(tx, tasks)
+}
+
+func (us *unifiedStore) putFailed(tx *gorm.DB, failedTasks []FailedTask) error {
+	tasks := make([]Task, len(failedTasks))
+	for i, failedTask := range failedTasks {
+		tasks[i] = taskFromFailed(failedTask)
+	}
+	return us.put(tx, tasks)
+}
+
+func (us *unifiedStore) reserve(tx *gorm.DB, keyStrs []string, now time.Time) (bool, error) {
+	tasks := make([]Task, len(keyStrs))
+	for i, keyStr := range keyStrs {
+		tasks[i] = Task{Key: keyStr, State: TaskPending, ClaimedAt: now}
+	}
+	result := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"owner", "claim_id", "cancelled"}),
+		Where: clause.Where{Exprs: []clause.Expression{gorm.Expr(
+			"(tasks.owner = '' OR tasks.claimed_at < ? OR tasks.cancelled) AND (tasks.value_expires_at IS NULL OR tasks.value_expires_at <= ?)", now.Add(-us.pendingTTL), now,
+		)}},
+	}).Create(&tasks)
+	return result.RowsAffected == int64(len(keyStrs)), result.Error
+}
+
+func (us *unifiedStore) deleteKeys(tx *gorm.DB, keyStrs []string) error {
+	return tx.Where("key IN ?", keyStrs).Delete(&Task{}).Error
+}
+
+func (us *unifiedStore) deleteAll(tx *gorm.DB) error {
+	return tx.Where("key LIKE ?", us.namespace+"-%").Delete(&Task{}).Error
+}
+
+func (us *unifiedStore) extendExpiry(keyStrs []string, now time.Time, until time.Time) error {
+	return us.db.Model(&Task{}).
+		Where("key IN ?", keyStrs).
+		Where("value_expires_at > ? AND value_expires_at < ?", now, until).
+		Update("value_expires_at", until).Error
+}
+
+// clears whatever has run out in each row, then deletes the rows left with nothing in them
+func (us *unifiedStore) reap(now time.Time, staleRetention time.Duration) error {
+	return us.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Task{}).Scopes(us.inNamespace).Where("failure_expires_at < ?", now).Updates(map[string]any{
+			"state":              gorm.Expr("CASE WHEN state = 'failed' AND value_expires_at IS NOT NULL THEN 'completed' ELSE state END"),
+			"failure_expires_at": nil,
+			"failed_at":          time.Time{},
+			"error_string":       "",
+			"timed_out":          false,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Model(&Task{}).Scopes(us.inNamespace).Where("value_expires_at < ?", now.Add(-staleRetention)).Updates(map[string]any{
+			"value_expires_at": nil,
+			"value_created_at": time.Time{},
+			"value":            "",
+			"computed_by":      "",
+			"getter_duration":  0,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Model(&Task{}).Scopes(us.inNamespace).Where("owner <> '' AND claimed_at < ?", now.Add(-us.pendingTTL)).Updates(map[string]any{
+			"state":     gorm.Expr(settledTaskStateSQL),
+			"owner":     "",
+			"claim_id":  "",
+			"cancelled": false,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		return us.deleteSettled(tx, us.inNamespace)
+	})
+}
+
+func (us *unifiedStore) hasValueSQL(keyColumn string) string {
+	return "EXISTS (SELECT 1 FROM tasks WHERE tasks.key = " + keyColumn + " AND tasks.value_expires_at IS NOT NULL)"
+}
+
+func (us *unifiedStore) close() {
+	us.taskBatcher.Close()
+}
+
+// MigrateToUnifiedSchema copies every pool's pending claims, values and failures from the pending_tasks, completed_tasks and failed_tasks tables into the tasks table used by WithUnifiedSchema
+// keys already in the tasks table are left alone, and values written before expires_at existed are copied as already expired
+// the old tables are kept, so pools still on them carry on working while the rest switch over; run it again once they have all switched to pick up anything written since
+func MigrateToUnifiedSchema(db *gorm.DB) error {
+	// rows written by older versions may be missing columns added since, so the old tables are brought up to date first
+	err := Migrate(db)
+	if err != nil {
+		return err
+	}
+	return db.Exec(`INSERT INTO tasks (
+		key, state, owner, claim_id, claimed_at, priority, cancelled, attempts,
+		value_expires_at, value_created_at, value, computed_by, getter_duration,
+		failure_expires_at, failed_at, error_string, timed_out
+	)
+	SELECT
+		keys.key,
+		CASE WHEN pending.key IS NOT NULL THEN 'pending' WHEN failed.key IS NOT NULL THEN 'failed' ELSE 'completed' END,
+		COALESCE(pending.owner, ''),
+		COALESCE(pending.claim_id, ''),
+		COALESCE(pending.created_at, ?),
+		COALESCE(pending.priority, 0),
+		COALESCE(pending.cancelled, false),
+		CASE WHEN pending.key IS NOT NULL THEN 1 ELSE 0 END,
+		CASE WHEN completed.key IS NOT NULL THEN COALESCE(completed.expires_at, completed.created_at) END,
+		COALESCE(completed.created_at, ?),
+		COALESCE(completed.value, ''),
+		COALESCE(completed.computed_by, ''),
+		COALESCE(completed.getter_duration, 0),
+		CASE WHEN failed.key IS NOT NULL THEN COALESCE(failed.expires_at, failed.created_at) END,
+		COALESCE(failed.created_at, ?),
+		COALESCE(failed.error_string, ''),
+		COALESCE(failed.timed_out, false)
+	FROM (
+		SELECT key FROM pending_tasks
+		UNION SELECT key FROM completed_tasks
+		UNION SELECT key FROM failed_tasks
+	) AS keys
+	LEFT JOIN pending_tasks AS pending ON pending.key = keys.key
+	LEFT JOIN completed_tasks AS completed ON completed.key = keys.key
+	LEFT JOIN failed_tasks AS failed ON failed.key = keys.key
+	ON CONFLICT (key) DO NOTHING`, time.Time{}, time.Time{}, time.Time{}).Error
+}
@@ -0,0 +1,104 @@
+package deduplicate
+
+import (
+	"context"
+	"sync"
+)
+
+// every Watch on the same key within a pool shares one underlying load
+type watch[VALUE_TYPE any] struct {
+	subscribers map[chan Result[VALUE_TYPE]]struct{}
+	cancel      func()
+	done        chan struct{}
+}
+
+type watches[VALUE_TYPE any] struct {
+	byKey map[string]*watch[VALUE_TYPE]
+	lock  *sync.Mutex
+}
+
+func newWatches[VALUE_TYPE any]() watches[VALUE_TYPE] {
+	return watches[VALUE_TYPE]{
+		byKey: map[string]*watch[VALUE_TYPE]{},
+		lock:  &sync.Mutex{},
+	}
+}
+
+// Watch delivers a key's final value or error exactly once, whichever pod produces it, starting the task if nobody has
+// the channel is closed after delivery, or without a delivery if ctx is cancelled first
+// options only apply if this call starts the shared load
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) Watch(ctx context.Context, key KEY_TYPE, opts ...LoadOption) <-chan Result[VALUE_TYPE] {
+	subscriber := make(chan Result[VALUE_TYPE], 1)
+
+	keyStr, err := tp.getKeyStr(key)
+	if err != nil {
+		subscriber <- Result[VALUE_TYPE]{Err: err}
+		close(subscriber)
+		return subscriber
+	}
+
+	tp.watches.lock.Lock()
+	w, ok := tp.watches.byKey[keyStr]
+	if !ok {
+		watchCtx, cancel := context.WithCancel(context.Background())
+		w = &watch[VALUE_TYPE]{
+			subscribers: map[chan Result[VALUE_TYPE]]struct{}{},
+			cancel:      cancel,
+			done:        make(chan struct{}),
+		}
+		tp.watches.byKey[keyStr] = w
+		go tp.runWatch(watchCtx, key, keyStr, w, newLoadOptions(opts))
+	}
+	w.subscribers[subscriber] = struct{}{}
+	tp.watches.lock.Unlock()
+
+	go func() {
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			tp.unsubscribe(keyStr, w, subscriber)
+		}
+	}()
+
+	return subscriber
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) runWatch(ctx context.Context, key KEY_TYPE, keyStr string, w *watch[VALUE_TYPE], call loadOptions) {
+	result := Result[VALUE_TYPE]{}
+	err := tp.enter()
+	if err == nil {
+		result, err = tp.load(ctx, key, loadAwait, call)
+		tp.leave()
+	}
+	result.Err = err
+
+	tp.watches.lock.Lock()
+	defer tp.watches.lock.Unlock()
+	if tp.watches.byKey[keyStr] == w {
+		delete(tp.watches.byKey, keyStr)
+	}
+	for subscriber := range w.subscribers {
+		subscriber <- result
+		close(subscriber)
+	}
+	w.subscribers = map[chan Result[VALUE_TYPE]]struct{}{}
+	close(w.done)
+	w.cancel()
+}
+
+// the shared load is abandoned once its last subscriber leaves
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) unsubscribe(keyStr string, w *watch[VALUE_TYPE], subscriber chan Result[VALUE_TYPE]) {
+	tp.watches.lock.Lock()
+	defer tp.watches.lock.Unlock()
+	if _, ok := w.subscribers[subscriber]; !ok {
+		return
+	}
+	delete(w.subscribers, subscriber)
+	close(subscriber)
+	if len(w.subscribers) == 0 {
+		w.cancel()
+		if tp.watches.byKey[keyStr] == w {
+			delete(tp.watches.byKey, keyStr)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package deduplicate
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotPersisted is matched (with errors.Is) by every PersistError
+var ErrNotPersisted = errors.New("result could not be stored")
+
+// returned by write-through loads whose result was computed but couldn't be stored; the computed value is still returned alongside it
+type PersistError struct {
+	Cause error
+}
+
+func (pe PersistError) Error() string {
+	return "result could not be stored: " + pe.Cause.Error()
+}
+
+func (pe PersistError) Unwrap() []error {
+	return []error{ErrNotPersisted, pe.Cause}
+}
+
+// describes a failed attempt to store a result, for WithPersistFailureHook
+type PersistFailure[KEY_TYPE comparable] struct {
+	Key     KEY_TYPE
+	Err     error
+	Attempt int
+	// set when no more attempts will be made
+	Final bool
+}
+
+const (
+	defaultWriteQueueSize   = 1000
+	defaultWriteWorkers     = 4
+	defaultWriteMaxAttempts = 5
+	defaultWriteBackoff     = time.Millisecond * 100
+	maxWriteBackoff         = time.Second * 10
+)
+
+// stores results in the background, retrying failed writes with exponential backoff
+type writeBehind[KEY_TYPE comparable] struct {
+	queue        chan pendingWrite[KEY_TYPE]
+	writeThrough bool
+	maxAttempts  int
+	backoff      time.Duration
+	onFailure    func(PersistFailure[KEY_TYPE])
+
+	retries  *atomic.Uint64
+	failures *atomic.Uint64
+}
+
+type pendingWrite[KEY_TYPE comparable] struct {
+	key    KEY_TYPE
+	write  func() error
+	giveUp func()
+	done   func()
+}
+
+// the write-behind queue's counts, as seen by Stats
+type WriteStats struct {
+	// writes waiting to be made
+	Queued int
+	// attempts that failed and were retried, and writes that were given up on, since the pool started
+	Retries  uint64
+	Failures uint64
+}
+
+func (wb *writeBehind[KEY_TYPE]) run() {
+	for pending := range wb.queue {
+		_ = wb.attempt(pending.key, pending.write, pending.giveUp)
+		pending.done()
+	}
+}
+
+// makes a write, retrying it until it succeeds or runs out of attempts, in which case giveUp is called
+func (wb *writeBehind[KEY_TYPE]) attempt(key KEY_TYPE, write func() error, giveUp func()) error {
+	backoff := wb.backoff
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil {
+			return nil
+		}
+		final := attempt >= wb.maxAttempts
+		if wb.onFailure != nil {
+			wb.onFailure(PersistFailure[KEY_TYPE]{Key: key, Err: err, Attempt: attempt, Final: final})
+		}
+		if final {
+			wb.failures.Add(1)
+			log.Printf("giving up storing result after %d attempts: %v", attempt, err)
+			giveUp()
+			return PersistError{Cause: err}
+		}
+		wb.retries.Add(1)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxWriteBackoff {
+			backoff = maxWriteBackoff
+		}
+	}
+}
+
+// stores a result in the background, or right away if write-through is in effect; the write is tracked, so Close waits for it
+// a result that can't be stored gives up the claim it was computed under, so that pods waiting on it try again straight away instead of waiting out pendingTTL
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) persist(key KEY_TYPE, keyStr string, claimID string, write func() error, call loadOptions) error {
+	wb := tp.writes
+	giveUp := func() { tp.deletePendingTask(keyStr, claimID) }
+	if wb.writeThrough || call.writeThrough {
+		return wb.attempt(key, write, giveUp)
+	}
+	tp.inFlight.Add(1)
+	select {
+	case wb.queue <- pendingWrite[KEY_TYPE]{key: key, write: write, giveUp: giveUp, done: tp.inFlight.Done}:
+	default:
+		// a full queue pushes back on callers rather than growing without bound
+		defer tp.inFlight.Done()
+		_ = wb.attempt(key, write, giveUp)
+	}
+	return nil
+}
+
+func (tp *TaskPool[KEY_TYPE, VALUE_TYPE]) writeStats() WriteStats {
+	return WriteStats{
+		Queued:   len(tp.writes.queue),
+		Retries:  tp.writes.retries.Load(),
+		Failures: tp.writes.failures.Load(),
+	}
+}